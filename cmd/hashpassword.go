@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"moxxiproxy/models"
+	"os"
+	"strings"
+)
+
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password [password]",
+	Short: "Hash a password for the users file, reads it from stdin when not given",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		algorithm, _ := cmd.Flags().GetString("algorithm")
+		username, _ := cmd.Flags().GetString("username")
+
+		password := ""
+		if len(args) == 1 {
+			password = args[0]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				log.Fatal().Err(err).Msg("reading password from stdin")
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+		if password == "" {
+			log.Fatal().Msg("empty password")
+		}
+
+		hash, err := models.HashPassword(password, algorithm)
+		if err != nil {
+			log.Fatal().Err(err).Msg("hashing password")
+		}
+		if username != "" {
+			fmt.Printf("%s: '%s'\n", username, hash)
+			return
+		}
+		fmt.Println(hash)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(hashPasswordCmd)
+	hashPasswordCmd.Flags().String("algorithm", models.PasswordBcrypt, "--algorithm=bcrypt or --algorithm=argon2id")
+	hashPasswordCmd.Flags().String("username", "", "--username=user1 prints a users file entry")
+}
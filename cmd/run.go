@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 var runCmd = &cobra.Command{
@@ -15,17 +16,45 @@ var runCmd = &cobra.Command{
 	Short: "Run proxy server",
 	Run: func(cmd *cobra.Command, args []string) {
 		listenAddress, _ := cmd.Flags().GetString("address")
+		socks5Address, _ := cmd.Flags().GetString("socks5address")
 		exitnodesFile, _ := cmd.Flags().GetString("exitnodes")
+		watchExitnodes, _ := cmd.Flags().GetBool("watchexitnodes")
+		watchUsers, _ := cmd.Flags().GetBool("watchusers")
 		whitelist, _ := cmd.Flags().GetString("whitelist")
+		denylist, _ := cmd.Flags().GetString("denylist")
+		whitelistFile, _ := cmd.Flags().GetString("whitelistfile")
+		allowDestinations, _ := cmd.Flags().GetStringSlice("allowdestinations")
+		denyDestinations, _ := cmd.Flags().GetStringSlice("denydestinations")
+		allowPrivateDestinations, _ := cmd.Flags().GetBool("allowprivatedestinations")
+		connectPorts, _ := cmd.Flags().GetStringSlice("connectports")
+		socks5Ports, _ := cmd.Flags().GetStringSlice("socks5ports")
 		auth, _ := cmd.Flags().GetString("auth")
 		loglevel, _ := cmd.Flags().GetString("loglevel")
 		timeout, _ := cmd.Flags().GetInt("timeout")
+		retries, _ := cmd.Flags().GetInt("retries")
+		drainTimeout, _ := cmd.Flags().GetDuration("draintimeout")
+		maxConnections, _ := cmd.Flags().GetInt("maxconnections")
+		rateLimit, _ := cmd.Flags().GetFloat64("ratelimit")
+		hostRateLimit, _ := cmd.Flags().GetFloat64("hostratelimit")
+		strategy, _ := cmd.Flags().GetString("strategy")
+		sessionTTL, _ := cmd.Flags().GetDuration("sessionttl")
+		maxSessions, _ := cmd.Flags().GetInt("maxsessions")
+		sessionStoreURL, _ := cmd.Flags().GetString("sessionstore")
+		quotaFile, _ := cmd.Flags().GetString("quotafile")
 		isUpstream, _ := cmd.Flags().GetBool("upstream")
 		authUpstream, _ := cmd.Flags().GetBool("authupstream")
 		prettyLogs, _ := cmd.Flags().GetBool("prettylogs")
 		metricsLogger, _ := cmd.Flags().GetString("metrics")
 		promaddress, _ := cmd.Flags().GetString("promaddress")
+		adminAddress, _ := cmd.Flags().GetString("adminaddress")
+		adminToken, _ := cmd.Flags().GetString("admintoken")
 		usersfile, _ := cmd.Flags().GetString("usersfile")
+		authBackend, _ := cmd.Flags().GetString("authbackend")
+		authCacheTTL, _ := cmd.Flags().GetDuration("authcachettl")
+		authNegativeTTL, _ := cmd.Flags().GetDuration("authnegativettl")
+		healthInterval, _ := cmd.Flags().GetInt("healthinterval")
+		healthFailures, _ := cmd.Flags().GetInt("healthfailures")
+		healthTarget, _ := cmd.Flags().GetString("healthtarget")
 		if prettyLogs == true {
 			log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 		}
@@ -34,6 +63,14 @@ var runCmd = &cobra.Command{
 			log.Fatal().Msg("Invalid metrics logger")
 		}
 
+		if adminAddress != "" && adminToken == "" {
+			log.Fatal().Msg("admintoken is required to enable the admin API")
+		}
+
+		if models.ValidStrategy(strategy) == false {
+			log.Fatal().Str("strategy", strategy).Msg("Invalid strategy")
+		}
+
 		if logLevel, err := zerolog.ParseLevel(loglevel); err == nil {
 			if logLevel == zerolog.NoLevel {
 				zerolog.SetGlobalLevel(zerolog.InfoLevel)
@@ -47,24 +84,71 @@ var runCmd = &cobra.Command{
 		if authParts := strings.Split(auth, ":"); len(authParts) > 1 {
 			username = authParts[0]
 			password = authParts[1]
-			models.UserMap = make(map[string]string)
-			models.UserMap[username] = password
-		} else if usersfile != "" {
-			models.Users{}.Load(usersfile)
+			models.SetUser(username, password)
+			usersfile = ""
+		} else if authBackend != "" && authBackend != "users" {
+			backend, err := models.NewAuthenticator(authBackend, authCacheTTL, authNegativeTTL)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid auth backend")
+			}
+			models.SetAuthenticator(backend)
+		}
+		// with another backend the users file only maps client addresses to users
+		if usersfile != "" {
+			if err := (models.Users{}).Load(usersfile); os.IsNotExist(err) {
+				log.Debug().Err(err).Str("filename", usersfile).Msg("Users.Load")
+			} else if err != nil {
+				// starting without users would turn authentication off
+				log.Fatal().Err(err).Str("filename", usersfile).Msg("Users.Load")
+			}
+		}
+
+		var sessionStore models.SessionStore
+		if sessionStoreURL != "" {
+			var err error
+			if sessionStore, err = models.NewSessionStore(sessionStoreURL); err != nil {
+				log.Fatal().Err(err).Msg("Invalid session store")
+			}
+		}
+
+		quotas, err := models.NewQuotaTracker(quotaFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid quota file")
 		}
 
 		s := models.Proxy{
-			ExitNodesFile: exitnodesFile,
-			ListenAddress: listenAddress,
-			Timeout:       timeout,
-			Mutex:         &sync.Mutex{},
-			SessionMutex:  &sync.Mutex{},
-			Sessions:      map[string]models.ExitNode{},
-			Username:      username,
-			Password:      password,
-			Whitelist:     whitelist,
-			IsUpstream:    isUpstream,
-			AuthUpstream:  authUpstream,
+			ExitNodesFile:            exitnodesFile,
+			WatchExitNodes:           watchExitnodes,
+			AuthenticatedUsersFile:   usersfile,
+			WatchUsers:               watchUsers,
+			ListenAddress:            listenAddress,
+			Socks5Address:            socks5Address,
+			Timeout:                  timeout,
+			DrainTimeout:             drainTimeout,
+			Retries:                  retries,
+			MaxConnectionsPerUser:    maxConnections,
+			RateLimitPerUser:         rateLimit,
+			HostRateLimitPerUser:     hostRateLimit,
+			Strategy:                 strategy,
+			Mutex:                    &sync.Mutex{},
+			SessionMutex:             &sync.Mutex{},
+			Sessions:                 map[string]*models.Session{},
+			SessionTTL:               sessionTTL,
+			MaxSessions:              maxSessions,
+			SessionStore:             sessionStore,
+			Quotas:                   quotas,
+			Username:                 username,
+			Password:                 password,
+			Whitelist:                whitelist,
+			DenyList:                 denylist,
+			WhitelistFile:            whitelistFile,
+			AllowDestinations:        allowDestinations,
+			DenyDestinations:         denyDestinations,
+			AllowPrivateDestinations: allowPrivateDestinations,
+			ConnectPorts:             connectPorts,
+			Socks5Ports:              socks5Ports,
+			IsUpstream:               isUpstream,
+			AuthUpstream:             authUpstream,
 			ExitNodes: struct {
 				All          []models.ExitNode
 				ByRegion     map[string][]models.ExitNode
@@ -74,9 +158,14 @@ var runCmd = &cobra.Command{
 				ByRegion:     map[string][]models.ExitNode{},
 				ByInstanceID: map[string]models.ExitNode{},
 			},
-			LogMetrics:        metricsLogger != "",
-			MetricsLogger:     metricsLogger,
-			PrometheusAddress: promaddress,
+			LogMetrics:          metricsLogger != "",
+			MetricsLogger:       metricsLogger,
+			PrometheusAddress:   promaddress,
+			AdminAddress:        adminAddress,
+			AdminToken:          adminToken,
+			HealthCheckInterval: healthInterval,
+			HealthCheckFailures: healthFailures,
+			HealthCheckTarget:   healthTarget,
 		}
 		s.Run()
 	},
@@ -85,16 +174,44 @@ var runCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(runCmd)
 	runCmd.PersistentFlags().Int("timeout", 0, "--timeout=0")
+	runCmd.PersistentFlags().Int("retries", 0, "--retries=2")
+	runCmd.PersistentFlags().Duration("draintimeout", 30*time.Second, "--draintimeout=30s")
+	runCmd.PersistentFlags().Int("maxconnections", 0, "--maxconnections=1000")
+	runCmd.PersistentFlags().Float64("ratelimit", 0, "--ratelimit=50")
+	runCmd.PersistentFlags().Float64("hostratelimit", 0, "--hostratelimit=5")
+	runCmd.PersistentFlags().String("strategy", models.StrategyRandom, "--strategy=random,roundrobin,weighted,leastconn,leastbytes")
+	runCmd.PersistentFlags().Duration("sessionttl", 30*time.Minute, "--sessionttl=30m")
+	runCmd.PersistentFlags().Int("maxsessions", 0, "--maxsessions=100000")
+	runCmd.PersistentFlags().String("sessionstore", "", "--sessionstore=file://./sessions.json or --sessionstore=redis://localhost:6379/0")
+	runCmd.PersistentFlags().String("quotafile", "", "--quotafile=./usage.json")
 	runCmd.PersistentFlags().String("metrics", "", "--metrics=prometheus,stdout or --metrics=stdout")
 	runCmd.PersistentFlags().String("promaddress", "0.0.0.0:2122", "--promaddress=:2122")
+	runCmd.PersistentFlags().String("adminaddress", "", "--adminaddress=127.0.0.1:2123")
+	runCmd.PersistentFlags().String("admintoken", "", "--admintoken=secret")
 	runCmd.PersistentFlags().String("address", "0.0.0.0:1989", "--address=:1989")
+	runCmd.PersistentFlags().String("socks5address", "", "--socks5address=:1080")
 	runCmd.PersistentFlags().String("exitnodes", "./exitNodes.yml", "--exitnodes=./exitnodes.yml")
+	runCmd.PersistentFlags().Bool("watchexitnodes", true, "--watchexitnodes=true")
 	runCmd.PersistentFlags().String("auth", "", "--auth=user:pass")
-	runCmd.PersistentFlags().String("whitelist", "", "--whitelist=1.2.3.4,5.6.7.8")
+	runCmd.PersistentFlags().String("whitelist", "", "--whitelist=1.2.3.4,10.0.0.0/8,2001:db8::/32")
+	runCmd.PersistentFlags().String("denylist", "", "--denylist=10.0.0.66,192.0.2.0/24")
+	runCmd.PersistentFlags().String("whitelistfile", "", "--whitelistfile=./whitelist.yml")
+	runCmd.PersistentFlags().StringSlice("allowdestinations", nil, "--allowdestinations=*.example.com,203.0.113.0/24:443,10.1.2.3:8000-8999")
+	runCmd.PersistentFlags().StringSlice("denydestinations", nil, "--denydestinations=*.internal,[2001:db8::/32]:25")
+	runCmd.PersistentFlags().Bool("allowprivatedestinations", false, "--allowprivatedestinations=false")
+	runCmd.PersistentFlags().StringSlice("connectports", models.DefaultConnectPorts, "--connectports=443,8443,5222-5223 or --connectports=* for any")
+	runCmd.PersistentFlags().StringSlice("socks5ports", models.DefaultSocks5Ports, "--socks5ports=80,443")
 	runCmd.PersistentFlags().String("loglevel", "info", "--loglevel=info")
 	runCmd.PersistentFlags().String("usersfile", "./users.yml", "--usersfile=./users.yml")
+	runCmd.PersistentFlags().Bool("watchusers", true, "--watchusers=true")
+	runCmd.PersistentFlags().String("authbackend", "users", "--authbackend=users, htpasswd://./.htpasswd, https://auth.example.com/check or ldaps://ldap.example.com/?dn=uid=%s,ou=people,dc=example,dc=com")
+	runCmd.PersistentFlags().Duration("authcachettl", time.Minute, "--authcachettl=1m")
+	runCmd.PersistentFlags().Duration("authnegativettl", 10*time.Second, "--authnegativettl=10s")
 	runCmd.PersistentFlags().Bool("upstream", false, "--upstream=false")
 	runCmd.PersistentFlags().Bool("authupstream", false, "--authupstream=false")
+	runCmd.PersistentFlags().Int("healthinterval", 0, "--healthinterval=30")
+	runCmd.PersistentFlags().Int("healthfailures", 3, "--healthfailures=3")
+	runCmd.PersistentFlags().String("healthtarget", "1.1.1.1:443", "--healthtarget=1.1.1.1:443")
 	runCmd.PersistentFlags().Bool("prettylogs", false, "--prettylogs=true")
 	runCmd.PersistentFlags().Bool("verbose", false, "DEPRECATED, use loglevel instead")
 	runCmd.Flags()
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var ErrDestinationNotAllowed = errors.New("destination not allowed")
+
+// not private for netip, 0.0.0.0/8 reaches localhost on Linux
+var specialPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+type destinationRule struct {
+	host     string
+	prefix   netip.Prefix
+	isPrefix bool
+	minPort  int
+	maxPort  int
+}
+
+// IPv6 with a port goes in brackets: [2001:db8::/32]:443
+func parseDestinationRule(value string) (destinationRule, error) {
+	rule := destinationRule{}
+	host, port := strings.TrimSpace(value), ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("invalid destination %q", value)
+		}
+		host, port = host[1:end], strings.TrimPrefix(host[end+1:], ":")
+	} else if strings.Count(host, ":") == 1 {
+		host, port, _ = strings.Cut(host, ":")
+	}
+	if host == "" {
+		return rule, fmt.Errorf("invalid destination %q", value)
+	}
+
+	if port != "" && port != "*" {
+		var err error
+		if rule.minPort, rule.maxPort, err = parsePortRange(port); err != nil {
+			return rule, fmt.Errorf("invalid port in %q", value)
+		}
+	}
+
+	if prefix, err := parsePrefix(host); err == nil {
+		rule.prefix = prefix
+		rule.isPrefix = true
+		return rule, nil
+	}
+	rule.host = strings.ToLower(host)
+	if _, err := path.Match(rule.host, ""); err != nil {
+		return rule, fmt.Errorf("invalid host pattern %q", value)
+	}
+	return rule, nil
+}
+
+func parsePortRange(value string) (int, int, error) {
+	low, high, isRange := strings.Cut(strings.TrimSpace(value), "-")
+	minPort, err := strconv.Atoi(low)
+	if err != nil || minPort < 1 || minPort > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", value)
+	}
+	maxPort := minPort
+	if isRange == true {
+		if maxPort, err = strconv.Atoi(high); err != nil || maxPort < minPort || maxPort > 65535 {
+			return 0, 0, fmt.Errorf("invalid port range %q", value)
+		}
+	}
+	return minPort, maxPort, nil
+}
+
+func parseDestinationRules(values []string) ([]destinationRule, error) {
+	var rules []destinationRule
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		rule, err := parseDestinationRule(v)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// a zero port only matches rules without a port
+func (r destinationRule) matches(host string, port int) bool {
+	if r.minPort > 0 && (port < r.minPort || port > r.maxPort) {
+		return false
+	}
+	if r.isPrefix == true {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(addr.Unmap())
+	}
+	ok, _ := path.Match(r.host, host)
+	return ok
+}
+
+func matchesDestination(rules []destinationRule, host string, port int) bool {
+	for _, rule := range rules {
+		if rule.matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitDestination(hostport string, defaultPort int) (string, int) {
+	host, port := hostport, defaultPort
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+		if parsed, err := strconv.Atoi(p); err == nil {
+			port = parsed
+		}
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.ToLower(host), port
+}
+
+func requestDestination(request *http.Request) (string, int) {
+	defaultPort := 80
+	if request.Method == http.MethodConnect || (request.URL != nil && request.URL.Scheme == "https") {
+		defaultPort = 443
+	}
+	return splitDestination(request.Host, defaultPort)
+}
+
+func isPrivateAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range specialPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type destinationACL struct {
+	allow []destinationRule
+	deny  []destinationRule
+}
+
+func (p *Proxy) loadDestinationACL() error {
+	allow, err := parseDestinationRules(p.AllowDestinations)
+	if err != nil {
+		return err
+	}
+	deny, err := parseDestinationRules(p.DenyDestinations)
+	if err != nil {
+		return err
+	}
+	p.destinations = destinationACL{allow: allow, deny: deny}
+	return nil
+}
+
+func (p *Proxy) allowsAddr(addr netip.Addr, port int) bool {
+	host := addr.Unmap().String()
+	if matchesDestination(p.destinations.deny, host, port) {
+		return false
+	}
+	if isPrivateAddr(addr) && p.AllowPrivateDestinations == false {
+		return matchesDestination(p.destinations.allow, host, port)
+	}
+	return true
+}
+
+// hostnames are checked again by dialControl once resolved
+func (p *Proxy) destinationRejection(requestContext RequestContext, host string, port int) string {
+	if requestContext.User.allowsDestination(host, port) == false {
+		return causeHostNotAllowed
+	}
+	if matchesDestination(p.destinations.deny, host, port) {
+		return causeDestinationNotAllowed
+	}
+	if len(p.destinations.allow) > 0 && matchesDestination(p.destinations.allow, host, port) == false {
+		return causeDestinationNotAllowed
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && p.allowsAddr(addr, port) == false {
+		return causeDestinationNotAllowed
+	}
+	if (host == "localhost" || strings.HasSuffix(host, ".localhost")) && p.AllowPrivateDestinations == false &&
+		matchesDestination(p.destinations.allow, host, port) == false {
+		return causeDestinationNotAllowed
+	}
+	return ""
+}
+
+func (p *Proxy) dialControl(user User) func(string, string, syscall.RawConn) error {
+	return func(_ string, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return err
+		}
+		if p.allowsAddr(addrPort.Addr(), int(addrPort.Port())) == false ||
+			user.allowsAddr(addrPort.Addr(), int(addrPort.Port())) == false {
+			return ErrDestinationNotAllowed
+		}
+		return nil
+	}
+}
+
+// upstreams resolve on their side
+func (p *Proxy) guardDialer(dialer proxy.Dialer, user User) proxy.Dialer {
+	netDialer, ok := dialer.(*net.Dialer)
+	if ok == false || p.IsUpstream == true {
+		return dialer
+	}
+	netDialer.Control = p.dialControl(user)
+	return netDialer
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		value   string
+		min     int
+		max     int
+		wantErr bool
+	}{
+		{"443", 443, 443, false},
+		{" 8000-8999 ", 8000, 8999, false},
+		{"1-65535", 1, 65535, false},
+		{"80-80", 80, 80, false},
+		{"0", 0, 0, true},
+		{"65536", 0, 0, true},
+		{"9000-8000", 0, 0, true},
+		{"8000-70000", 0, 0, true},
+		{"8000-", 0, 0, true},
+		{"-80", 0, 0, true},
+		{"http", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, tt := range tests {
+		minPort, maxPort, err := parsePortRange(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePortRange(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if minPort != tt.min || maxPort != tt.max {
+			t.Errorf("parsePortRange(%q) = %d, %d, want %d, %d", tt.value, minPort, maxPort, tt.min, tt.max)
+		}
+	}
+}
+
+func TestIsPrivateAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"64:ff9b::a00:1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"8.8.8.8", false},
+		{"100.128.0.1", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+		{"::ffff:8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPrivateAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
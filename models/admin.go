@@ -0,0 +1,293 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type adminExitNode struct {
+	ExitNode
+	Key       string `json:"key"`
+	Healthy   bool   `json:"healthy"`
+	Draining  bool   `json:"draining"`
+	Available bool   `json:"available"`
+	Active    int64  `json:"active_connections"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type adminSession struct {
+	Key          string        `json:"key"`
+	ExitNodeKey  string        `json:"exit_node"`
+	CreatedAt    time.Time     `json:"created_at"`
+	LastUsed     time.Time     `json:"last_used"`
+	TTL          time.Duration `json:"ttl"`
+	ExpiresInSec float64       `json:"expires_in_seconds,omitempty"`
+}
+
+type adminTunnel struct {
+	ID          uint64    `json:"id"`
+	Protocol    string    `json:"protocol"`
+	Host        string    `json:"host"`
+	UserID      string    `json:"user_id"`
+	Region      string    `json:"region,omitempty"`
+	Session     string    `json:"session,omitempty"`
+	ExitNodeKey string    `json:"exit_node"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+type adminUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /exitnodes", p.adminListExitNodes)
+	mux.HandleFunc("POST /exitnodes", p.adminAddExitNode)
+	mux.HandleFunc("DELETE /exitnodes", p.adminRemoveExitNode)
+	mux.HandleFunc("POST /exitnodes/drain", p.adminDrainExitNode(true))
+	mux.HandleFunc("POST /exitnodes/undrain", p.adminDrainExitNode(false))
+	mux.HandleFunc("GET /sessions", p.adminListSessions)
+	mux.HandleFunc("DELETE /sessions", p.adminDeleteSession)
+	mux.HandleFunc("GET /users", p.adminListUsers)
+	mux.HandleFunc("PUT /users", p.adminSetUser)
+	mux.HandleFunc("DELETE /users", p.adminDeleteUser)
+	mux.HandleFunc("POST /users/reload", p.adminReloadUsers)
+	mux.HandleFunc("GET /tunnels", p.adminListTunnels)
+
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if p.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) != 1 {
+			writeJSON(responseWriter, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(responseWriter, request)
+	})
+}
+
+func writeJSON(responseWriter http.ResponseWriter, status int, payload interface{}) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	if err := json.NewEncoder(responseWriter).Encode(payload); err != nil {
+		log.Debug().Err(err).Msg("writeJSON")
+	}
+}
+
+func writeJSONError(responseWriter http.ResponseWriter, status int, err error) {
+	writeJSON(responseWriter, status, map[string]string{"error": err.Error()})
+}
+
+func (p *Proxy) adminListExitNodes(responseWriter http.ResponseWriter, _ *http.Request) {
+	p.Mutex.Lock()
+	exitNodes := make([]adminExitNode, 0, len(p.configuredExitNodes))
+	for _, v := range p.configuredExitNodes {
+		exitNode := adminExitNode{
+			ExitNode:  v.Redacted(),
+			Key:       v.RedactedKey(),
+			Healthy:   p.isHealthy(v),
+			Draining:  p.drained[v.Key()],
+			Available: p.available[v.Key()],
+		}
+		if nodeStats, ok := p.stats[v.Key()]; ok {
+			exitNode.Active = atomic.LoadInt64(&nodeStats.Active)
+			exitNode.Bytes = atomic.LoadInt64(&nodeStats.Bytes)
+		}
+		exitNodes = append(exitNodes, exitNode)
+	}
+	p.Mutex.Unlock()
+	writeJSON(responseWriter, http.StatusOK, exitNodes)
+}
+
+func (p *Proxy) adminAddExitNode(responseWriter http.ResponseWriter, request *http.Request) {
+	var exitNode ExitNode
+	if err := json.NewDecoder(request.Body).Decode(&exitNode); err != nil {
+		writeJSONError(responseWriter, http.StatusBadRequest, err)
+		return
+	}
+	if exitNode.Interface == "" && exitNode.Upstream == "" {
+		writeJSONError(responseWriter, http.StatusBadRequest, errors.New("interface or upstream is required"))
+		return
+	}
+	if err := p.AddExitNode(exitNode); err != nil {
+		writeJSONError(responseWriter, http.StatusConflict, err)
+		return
+	}
+	log.Info().Str("exitNode", exitNode.RedactedKey()).Msg("admin added exitNode")
+	writeJSON(responseWriter, http.StatusCreated, map[string]string{"key": exitNode.RedactedKey()})
+}
+
+func (p *Proxy) adminRemoveExitNode(responseWriter http.ResponseWriter, request *http.Request) {
+	key := request.URL.Query().Get("key")
+	if err := p.RemoveExitNode(key); err != nil {
+		writeJSONError(responseWriter, exitNodeErrorStatus(err), err)
+		return
+	}
+	log.Info().Str("exitNode", redactKey(key)).Msg("admin removed exitNode")
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) adminDrainExitNode(drain bool) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		key := request.URL.Query().Get("key")
+		if err := p.DrainExitNode(key, drain); err != nil {
+			writeJSONError(responseWriter, exitNodeErrorStatus(err), err)
+			return
+		}
+		log.Info().Str("exitNode", redactKey(key)).Bool("drain", drain).Msg("admin drained exitNode")
+		responseWriter.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func exitNodeErrorStatus(err error) int {
+	if errors.Is(err, ErrExitNodeAmbiguous) {
+		return http.StatusConflict
+	}
+	return http.StatusNotFound
+}
+
+func (p *Proxy) adminListSessions(responseWriter http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	p.SessionMutex.Lock()
+	sessions := make([]adminSession, 0, len(p.Sessions))
+	for sessionKey, session := range p.Sessions {
+		if session.Expired(now) {
+			continue
+		}
+		item := adminSession{
+			Key:         sessionKey,
+			ExitNodeKey: session.ExitNode.RedactedKey(),
+			CreatedAt:   session.CreatedAt,
+			LastUsed:    session.LastUsed,
+			TTL:         session.TTL,
+		}
+		if session.TTL > 0 {
+			item.ExpiresInSec = session.LastUsed.Add(session.TTL).Sub(now).Seconds()
+		}
+		sessions = append(sessions, item)
+	}
+	p.SessionMutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Key < sessions[j].Key
+	})
+	writeJSON(responseWriter, http.StatusOK, sessions)
+}
+
+func (p *Proxy) adminDeleteSession(responseWriter http.ResponseWriter, request *http.Request) {
+	sessionKey := request.URL.Query().Get("key")
+	p.SessionMutex.Lock()
+	_, ok := p.Sessions[sessionKey]
+	p.deleteSession(sessionKey)
+	p.SessionMutex.Unlock()
+	if p.SessionStore != nil {
+		if err := p.SessionStore.Delete(sessionKey); err != nil {
+			writeJSONError(responseWriter, http.StatusBadGateway, err)
+			return
+		}
+		ok = true
+	}
+	if !ok {
+		writeJSONError(responseWriter, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) adminListUsers(responseWriter http.ResponseWriter, _ *http.Request) {
+	writeJSON(responseWriter, http.StatusOK, ListUsers())
+}
+
+func usersFileBackend(responseWriter http.ResponseWriter) bool {
+	if _, ok := currentAuthenticator().(MapAuthenticator); ok == false {
+		writeJSONError(responseWriter, http.StatusConflict, ErrUsersNotManaged)
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) adminSetUser(responseWriter http.ResponseWriter, request *http.Request) {
+	if usersFileBackend(responseWriter) == false {
+		return
+	}
+	var user adminUser
+	if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
+		writeJSONError(responseWriter, http.StatusBadRequest, err)
+		return
+	}
+	if user.Username == "" || strings.ContainsAny(user.Username, "_:") {
+		writeJSONError(responseWriter, http.StatusBadRequest, errors.New("username must be set and can't contain _ or :"))
+		return
+	}
+	if user.Password == "" {
+		writeJSONError(responseWriter, http.StatusBadRequest, errors.New("password must be set"))
+		return
+	}
+	// plaintext passwords are hashed
+	password := user.Password
+	if passwordScheme(password) == passwordPlain {
+		var err error
+		if password, err = HashPassword(password, PasswordBcrypt); err != nil {
+			writeJSONError(responseWriter, http.StatusInternalServerError, err)
+			return
+		}
+	} else if err := validatePassword(password); err != nil {
+		writeJSONError(responseWriter, http.StatusBadRequest, err)
+		return
+	}
+	if userCount() == 0 {
+		log.Warn().Str("username", user.Username).Msg("first user added, authentication is now required")
+	}
+	SetUser(user.Username, password)
+	log.Info().Str("username", user.Username).Msg("admin set user")
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) adminDeleteUser(responseWriter http.ResponseWriter, request *http.Request) {
+	if usersFileBackend(responseWriter) == false {
+		return
+	}
+	username := request.URL.Query().Get("username")
+	if _, ok := lookupUser(username); !ok {
+		writeJSONError(responseWriter, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+	DeleteUser(username)
+	log.Info().Str("username", username).Msg("admin deleted user")
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) adminReloadUsers(responseWriter http.ResponseWriter, _ *http.Request) {
+	if err := p.ReloadUsers(); err != nil {
+		writeJSONError(responseWriter, http.StatusUnprocessableEntity, err)
+		return
+	}
+	log.Info().Msg("admin reloaded users")
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) adminListTunnels(responseWriter http.ResponseWriter, _ *http.Request) {
+	tunnels := p.Tunnels()
+	items := make([]adminTunnel, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		items = append(items, adminTunnel{
+			ID:          tunnel.ID,
+			Protocol:    tunnel.Protocol,
+			Host:        tunnel.Host,
+			UserID:      tunnel.RequestContext.UserID,
+			Region:      tunnel.RequestContext.Region,
+			Session:     tunnel.RequestContext.Session,
+			ExitNodeKey: tunnel.ExitNode.RedactedKey(),
+			StartedAt:   tunnel.StartedAt,
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+	writeJSON(responseWriter, http.StatusOK, items)
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const authCallbackTimeout = 5 * time.Second
+
+type authCallbackRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	RawUsername string `json:"raw_username"`
+	Region      string `json:"region,omitempty"`
+	Project     string `json:"project,omitempty"`
+	Session     string `json:"session,omitempty"`
+	Instance    string `json:"instance,omitempty"`
+}
+
+type authCallbackResponse struct {
+	Allow bool `json:"allow"`
+	User  User `json:"user"`
+}
+
+type HTTPAuthenticator struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPAuthenticator(callbackURL string) (*HTTPAuthenticator, error) {
+	return &HTTPAuthenticator{
+		url:    callbackURL,
+		client: &http.Client{Timeout: authCallbackTimeout},
+	}, nil
+}
+
+func (h *HTTPAuthenticator) Authenticate(username string, password string, requestContext RequestContext) (User, bool, error) {
+	body, err := json.Marshal(authCallbackRequest{
+		Username:    username,
+		Password:    password,
+		RawUsername: requestContext.RawUsername,
+		Region:      requestContext.Region,
+		Project:     requestContext.Project,
+		Session:     requestContext.Session,
+		Instance:    requestContext.Instance,
+	})
+	if err != nil {
+		return User{}, false, err
+	}
+	response, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return User{}, false, err
+	}
+	defer response.Body.Close()
+
+	// 401 and 403 are answers, other errors fail the callback
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return User{}, false, nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return User{}, false, fmt.Errorf("auth callback answered %s", response.Status)
+	}
+	var result authCallbackResponse
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return User{}, false, fmt.Errorf("can't parse auth callback response: %w", err)
+	}
+	if result.Allow == false {
+		return User{}, false, nil
+	}
+	if err = result.User.prepare(); err != nil {
+		return User{}, false, fmt.Errorf("auth callback user: %w", err)
+	}
+	return result.User, true, nil
+}
+
+func (h *HTTPAuthenticator) Enabled() bool {
+	return true
+}
@@ -1,24 +1,236 @@
 package models
 
 import (
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
+	"net/netip"
 	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
+var ErrNoUsersFile = errors.New("no users file configured")
+var ErrEmptyUsersFile = errors.New("users file has no users")
+var ErrUsersNotManaged = errors.New("users are managed by the auth backend, not the users file")
+
 type Users struct{}
 
-var UserMap map[string]string
+type User struct {
+	Password       string           `yaml:"password" json:"-"`
+	Quota          Quota            `yaml:"quota" json:"quota,omitempty"`
+	ProjectQuotas  map[string]Quota `yaml:"project_quotas" json:"project_quotas,omitempty"`
+	MaxConnections int              `yaml:"max_connections" json:"max_connections,omitempty"`
+	RateLimit      float64          `yaml:"rate_limit" json:"rate_limit,omitempty"`
+	HostRateLimit  float64          `yaml:"host_rate_limit" json:"host_rate_limit,omitempty"`
+	Bandwidth      ByteSize         `yaml:"bandwidth" json:"bandwidth,omitempty"`
+	Regions        []string         `yaml:"regions" json:"regions,omitempty"`
+	Instances      []string         `yaml:"instances" json:"instances,omitempty"`
+	AllowedHosts   []string         `yaml:"allowed_hosts" json:"allowed_hosts,omitempty"`
+	BlockedHosts   []string         `yaml:"blocked_hosts" json:"blocked_hosts,omitempty"`
+	Expires        time.Time        `yaml:"expires" json:"expires,omitempty"`
+	Disabled       bool             `yaml:"disabled" json:"disabled,omitempty"`
+	IPs            []string         `yaml:"ips" json:"ips,omitempty"`
+	Region         string           `yaml:"region" json:"region,omitempty"`
+	Project        string           `yaml:"project" json:"project,omitempty"`
+	ConnectPorts   []string         `yaml:"connect_ports" json:"connect_ports,omitempty"`
+	Strategy       string           `yaml:"strategy" json:"strategy,omitempty"`
+
+	allowedHosts []destinationRule
+	blockedHosts []destinationRule
+}
+
+func (u *User) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var password string
+	if err := unmarshal(&password); err == nil {
+		*u = User{Password: password}
+		return nil
+	}
+	type rawUser User
+	raw := rawUser{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*u = User(raw)
+	return nil
+}
+
+func (u User) active(now time.Time) bool {
+	if u.Disabled == true {
+		return false
+	}
+	return u.Expires.IsZero() || now.Before(u.Expires)
+}
+
+func (u User) restricted() bool {
+	return len(u.Regions) > 0 || len(u.Instances) > 0
+}
+
+func (u User) allowsExitNode(exitNode ExitNode) bool {
+	if u.restricted() == false {
+		return true
+	}
+	return contains(u.Regions, exitNode.Region) || contains(u.Instances, exitNode.InstanceID)
+}
+
+func (u *User) prepare() error {
+	if u.Strategy != "" && ValidStrategy(u.Strategy) == false {
+		return fmt.Errorf("unknown strategy %q", u.Strategy)
+	}
+	if err := validatePorts(u.ConnectPorts); err != nil {
+		return fmt.Errorf("connect_ports: %w", err)
+	}
+	var err error
+	if u.allowedHosts, err = parseDestinationRules(u.AllowedHosts); err != nil {
+		return fmt.Errorf("allowed_hosts: %w", err)
+	}
+	if u.blockedHosts, err = parseDestinationRules(u.BlockedHosts); err != nil {
+		return fmt.Errorf("blocked_hosts: %w", err)
+	}
+	return nil
+}
+
+// *.example.com matches the subdomains but not example.com itself
+func (u User) allowsDestination(host string, port int) bool {
+	if matchesDestination(u.blockedHosts, host, port) {
+		return false
+	}
+	if len(u.allowedHosts) == 0 {
+		return true
+	}
+	return matchesDestination(u.allowedHosts, host, port)
+}
+
+// a hostname can't reach a blocked CIDR once resolved
+func (u User) allowsAddr(addr netip.Addr, port int) bool {
+	return matchesDestination(u.blockedHosts, addr.Unmap().String(), port) == false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var userMap map[string]User
+
+// passwords set through SetUser survive reloads, guarded by userMutex
+var apiPasswords = map[string]string{}
+
+var userMutex sync.RWMutex
+
+func (u Users) Load(filename string) error {
+	users, err := loadUsers(filename)
+	if err != nil {
+		return err
+	}
+	setUsers(users)
+	return nil
+}
 
-func (u Users) Load(filename string) {
+func setUsers(users map[string]User) {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+	for username, password := range apiPasswords {
+		user := users[username]
+		user.Password = password
+		users[username] = user
+	}
+	index := indexIPs(users)
+	userMap = users
+	ipUsers = index
+}
+
+func loadUsers(filename string) (map[string]User, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		log.Debug().Err(err).Str("filename", filename).Msg("Users.Load")
-		return
+		return nil, err
+	}
+	users := map[string]User{}
+	if err = yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("can't parse users file: %w", err)
 	}
+	plaintext := 0
+	for username, user := range users {
+		if err = user.prepare(); err != nil {
+			return nil, fmt.Errorf("user %s: %w", username, err)
+		}
+		users[username] = user
+		if err = validatePassword(user.Password); err != nil {
+			log.Warn().Err(err).Str("username", username).Msg("Users.Load.Password")
+		}
+		if passwordScheme(user.Password) == passwordPlain {
+			plaintext++
+		}
+	}
+	if plaintext > 0 {
+		log.Warn().Int("users", plaintext).Str("filename", filename).Msg("plaintext passwords, use moxxiproxy hash-password")
+	}
+	return users, nil
+}
 
-	err = yaml.Unmarshal(data, &UserMap)
+// no users would disable authentication
+func (p *Proxy) ReloadUsers() error {
+	if p.AuthenticatedUsersFile == "" {
+		return ErrNoUsersFile
+	}
+	users, err := loadUsers(p.AuthenticatedUsersFile)
+	if err == nil && len(users) == 0 && userCount() > 0 {
+		err = ErrEmptyUsersFile
+	}
 	if err != nil {
-		log.Info().Err(err).Str("filename", filename).Msg("Users.Load.Unmarshall")
+		log.Error().Err(err).Str("method", "ReloadUsers").Str("filename", p.AuthenticatedUsersFile).Msg("keeping previous users")
+		return err
+	}
+	setUsers(users)
+	log.Info().Int("users", len(users)).Msg("users reloaded")
+	return nil
+}
+
+func SetUser(username string, password string) {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+	if userMap == nil {
+		userMap = make(map[string]User)
+	}
+	user := userMap[username]
+	user.Password = password
+	userMap[username] = user
+	apiPasswords[username] = password
+}
+
+func DeleteUser(username string) {
+	userMutex.Lock()
+	defer userMutex.Unlock()
+	delete(userMap, username)
+	delete(apiPasswords, username)
+}
+
+func ListUsers() []string {
+	userMutex.RLock()
+	defer userMutex.RUnlock()
+	usernames := make([]string, 0, len(userMap))
+	for username := range userMap {
+		usernames = append(usernames, username)
 	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+func lookupUser(username string) (User, bool) {
+	userMutex.RLock()
+	defer userMutex.RUnlock()
+	user, ok := userMap[username]
+	return user, ok
+}
+
+func userCount() int {
+	userMutex.RLock()
+	defer userMutex.RUnlock()
+	return len(userMap)
 }
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const authCacheMax = 10000
+
+type Authenticator interface {
+	Authenticate(username string, password string, requestContext RequestContext) (User, bool, error)
+	Enabled() bool
+}
+
+var authenticator Authenticator = MapAuthenticator{}
+var authenticatorMutex sync.RWMutex
+
+func SetAuthenticator(a Authenticator) {
+	authenticatorMutex.Lock()
+	defer authenticatorMutex.Unlock()
+	authenticator = a
+}
+
+func currentAuthenticator() Authenticator {
+	authenticatorMutex.RLock()
+	defer authenticatorMutex.RUnlock()
+	return authenticator
+}
+
+func authenticationEnabled() bool {
+	return currentAuthenticator().Enabled()
+}
+
+func NewAuthenticator(rawURL string, positiveTTL time.Duration, negativeTTL time.Duration) (Authenticator, error) {
+	var backend Authenticator
+	if rawURL == "" || rawURL == "users" {
+		// caching would only delay reloads
+		return MapAuthenticator{}, nil
+	}
+	backendURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch backendURL.Scheme {
+	case "htpasswd":
+		backend, err = NewHtpasswdAuthenticator(urlFilename(backendURL))
+	case "http", "https":
+		backend, err = NewHTTPAuthenticator(rawURL)
+	case "ldap", "ldaps":
+		backend, err = NewLDAPAuthenticator(backendURL)
+	default:
+		err = fmt.Errorf("unsupported auth backend %q", backendURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if positiveTTL > 0 || negativeTTL > 0 {
+		backend = NewCachingAuthenticator(backend, positiveTTL, negativeTTL)
+	}
+	return backend, nil
+}
+
+type MapAuthenticator struct{}
+
+func (m MapAuthenticator) Authenticate(username string, password string, _ RequestContext) (User, bool, error) {
+	user, ok := lookupUser(username)
+	if ok == false {
+		return User{}, false, nil
+	}
+	if verified, err := verifyPassword(user.Password, password); verified == false {
+		return User{}, false, err
+	}
+	return user, true, nil
+}
+
+func (m MapAuthenticator) Enabled() bool {
+	return userCount() > 0
+}
+
+type authCacheEntry struct {
+	user    User
+	ok      bool
+	expires time.Time
+}
+
+// errors are never cached
+type CachingAuthenticator struct {
+	backend     Authenticator
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	mutex       sync.Mutex
+	entries     map[[sha256.Size]byte]authCacheEntry
+}
+
+func NewCachingAuthenticator(backend Authenticator, positiveTTL time.Duration, negativeTTL time.Duration) *CachingAuthenticator {
+	return &CachingAuthenticator{
+		backend:     backend,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		entries:     map[[sha256.Size]byte]authCacheEntry{},
+	}
+}
+
+// routing tokens the backend may decide on are part of the key
+func (c *CachingAuthenticator) Authenticate(username string, password string, requestContext RequestContext) (User, bool, error) {
+	key := credentialHash(requestContext.RawUsername, username, password)
+	now := time.Now()
+
+	c.mutex.Lock()
+	entry, found := c.entries[key]
+	c.mutex.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.user, entry.ok, nil
+	}
+
+	user, ok, err := c.backend.Authenticate(username, password, requestContext)
+	if err != nil {
+		return user, ok, err
+	}
+	ttl := c.negativeTTL
+	if ok == true {
+		ttl = c.positiveTTL
+	}
+	if ttl <= 0 {
+		return user, ok, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= authCacheMax {
+		c.entries = map[[sha256.Size]byte]authCacheEntry{}
+	}
+	c.entries[key] = authCacheEntry{
+		user:    user,
+		ok:      ok,
+		expires: now.Add(ttl),
+	}
+	return user, ok, nil
+}
+
+func (c *CachingAuthenticator) Enabled() bool {
+	return c.backend.Enabled()
+}
+
+// a failing backend denies the request
+func authenticate(username string, password string, requestContext RequestContext) (User, bool, error) {
+	user, ok, err := currentAuthenticator().Authenticate(username, password, requestContext)
+	if errors.Is(err, ErrPasswordCheckBusy) {
+		return User{}, false, err
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("username", username).Msg("authenticate")
+		return User{}, false, err
+	}
+	return user, ok, nil
+}
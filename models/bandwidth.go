@@ -0,0 +1,99 @@
+package models
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// token bucket shared by every copy of a user or exit node
+type throttle struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle(rate ByteSize) *throttle {
+	return &throttle{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (t *throttle) reserve(n int) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
+
+// caller must hold throttleMutex
+func throttleFor(throttles map[string]*throttle, key string, rate ByteSize) *throttle {
+	current, ok := throttles[key]
+	if !ok || current.rate != float64(rate) {
+		current = newThrottle(rate)
+		throttles[key] = current
+	}
+	return current
+}
+
+func (p *Proxy) throttles(requestContext RequestContext, exitNode ExitNode) []*throttle {
+	var limits []*throttle
+	user := requestContext.User
+
+	p.throttleMutex.Lock()
+	defer p.throttleMutex.Unlock()
+	if requestContext.UserID != "" && user.Bandwidth > 0 {
+		if p.userThrottles == nil {
+			p.userThrottles = map[string]*throttle{}
+		}
+		limits = append(limits, throttleFor(p.userThrottles, requestContext.UserID, user.Bandwidth))
+	}
+	if exitNode.Bandwidth > 0 {
+		if p.exitNodeThrottles == nil {
+			p.exitNodeThrottles = map[string]*throttle{}
+		}
+		limits = append(limits, throttleFor(p.exitNodeThrottles, exitNode.Key(), exitNode.Bandwidth))
+	}
+	return limits
+}
+
+type throttledWriter struct {
+	writer    io.Writer
+	throttles []*throttle
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	var wait time.Duration
+	for _, t := range w.throttles {
+		if delay := t.reserve(len(b)); delay > wait {
+			wait = delay
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return w.writer.Write(b)
+}
+
+func (p *Proxy) throttleWrap(writer io.Writer, requestContext RequestContext, exitNode ExitNode) io.Writer {
+	limits := p.throttles(requestContext, exitNode)
+	if len(limits) == 0 {
+		return writer
+	}
+	return &throttledWriter{
+		writer:    writer,
+		throttles: limits,
+	}
+}
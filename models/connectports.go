@@ -0,0 +1,55 @@
+package models
+
+import "strings"
+
+var DefaultConnectPorts = []string{"443"}
+
+// SOCKS5 clients also send plain HTTP
+var DefaultSocks5Ports = []string{"80", "443"}
+
+func allowsPort(ports []string, port int) bool {
+	for _, v := range ports {
+		if strings.TrimSpace(v) == "*" {
+			return true
+		}
+		minPort, maxPort, err := parsePortRange(v)
+		if err == nil && port >= minPort && port <= maxPort {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePorts(ports []string) error {
+	for _, v := range ports {
+		if strings.TrimSpace(v) == "*" {
+			continue
+		}
+		if _, _, err := parsePortRange(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) connectPortRejection(requestContext RequestContext, port int) string {
+	return p.portRejection(requestContext, p.ConnectPorts, DefaultConnectPorts, port)
+}
+
+func (p *Proxy) socks5PortRejection(requestContext RequestContext, port int) string {
+	return p.portRejection(requestContext, p.Socks5Ports, DefaultSocks5Ports, port)
+}
+
+func (p *Proxy) portRejection(requestContext RequestContext, ports []string, defaultPorts []string, port int) string {
+	if len(requestContext.User.ConnectPorts) > 0 {
+		ports = requestContext.User.ConnectPorts
+	}
+	if len(ports) == 0 {
+		ports = defaultPorts
+	}
+	if allowsPort(ports, port) == false {
+		p.LogRejection(requestContext, "port")
+		return causePortNotAllowed
+	}
+	return ""
+}
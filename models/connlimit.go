@@ -0,0 +1,43 @@
+package models
+
+func (p *Proxy) maxConnections(requestContext RequestContext) int64 {
+	if requestContext.User.MaxConnections > 0 {
+		return int64(requestContext.User.MaxConnections)
+	}
+	return int64(p.MaxConnectionsPerUser)
+}
+
+func (p *Proxy) acquireUserConnection(requestContext RequestContext) bool {
+	if requestContext.UserID == "" {
+		return true
+	}
+	limit := p.maxConnections(requestContext)
+
+	p.connectionMutex.Lock()
+	defer p.connectionMutex.Unlock()
+	if p.userConnections == nil {
+		p.userConnections = map[string]int64{}
+	}
+	if limit > 0 && p.userConnections[requestContext.UserID] >= limit {
+		p.LogRejection(requestContext, "connections")
+		return false
+	}
+	p.userConnections[requestContext.UserID]++
+	p.LogUserConnections(requestContext.UserID, p.userConnections[requestContext.UserID])
+	return true
+}
+
+func (p *Proxy) releaseUserConnection(requestContext RequestContext) {
+	if requestContext.UserID == "" {
+		return
+	}
+
+	p.connectionMutex.Lock()
+	defer p.connectionMutex.Unlock()
+	p.userConnections[requestContext.UserID]--
+	current := p.userConnections[requestContext.UserID]
+	if current <= 0 {
+		delete(p.userConnections, requestContext.UserID)
+	}
+	p.LogUserConnections(requestContext.UserID, current)
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+)
+
+const HeaderMoxxiError = "X-Moxxi-Error"
+
+const (
+	causeNotWhitelisted          = "client not whitelisted"
+	causeClientDenied            = "client denied"
+	causeNoExitNodes             = "no exit nodes available"
+	causeExitNodeUnreachable     = "exit node unreachable"
+	causeUpstreamRefused         = "upstream refused"
+	causeDestinationUnreachable  = "destination unreachable"
+	causeTimeout                 = "timeout"
+	causeInvalidExitNodeUpstream = "invalid exit node upstream"
+	causeQuotaExceeded           = "quota exceeded"
+	causeTooManyConnections      = "too many connections"
+	causeRateLimited             = "rate limited"
+	causeUserInactive            = "user disabled or expired"
+	causeRegionNotAllowed        = "region not allowed"
+	causeInstanceNotAllowed      = "instance not allowed"
+	causeHostNotAllowed          = "host not allowed"
+	causeDestinationNotAllowed   = "destination not allowed"
+	causePortNotAllowed          = "port not allowed"
+	causeAuthBusy                = "authentication busy"
+)
+
+var ErrUpstreamRefused = errors.New("upstream refused the request")
+
+type exitNodeError struct {
+	err error
+}
+
+func (e exitNodeError) Error() string {
+	return fmt.Sprintf("exit node: %s", e.err)
+}
+
+func (e exitNodeError) Unwrap() error {
+	return e.err
+}
+
+func classifyError(err error) (int, string) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout, causeTimeout
+	}
+	if errors.Is(err, ErrDestinationNotAllowed) {
+		return http.StatusForbidden, causeDestinationNotAllowed
+	}
+	if errors.Is(err, ErrNoExitNodes) {
+		return http.StatusServiceUnavailable, causeNoExitNodes
+	}
+	if errors.Is(err, ErrUpstreamRefused) {
+		return http.StatusBadGateway, causeUpstreamRefused
+	}
+	var nodeErr exitNodeError
+	if errors.As(err, &nodeErr) {
+		return http.StatusBadGateway, causeExitNodeUnreachable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return http.StatusBadGateway, causeExitNodeUnreachable
+	}
+	if errors.As(err, &opErr) && opErr.Op == "socks connect" {
+		return http.StatusBadGateway, causeUpstreamRefused
+	}
+	return http.StatusBadGateway, causeDestinationUnreachable
+}
+
+func writeProxyError(responseWriter http.ResponseWriter, status int, cause string) {
+	responseWriter.Header().Set(HeaderMoxxiError, cause)
+	http.Error(responseWriter, fmt.Sprintf("%d %s: %s", status, http.StatusText(status), cause), status)
+}
+
+func writeClassifiedError(responseWriter http.ResponseWriter, err error) {
+	status, cause := classifyError(err)
+	writeProxyError(responseWriter, status, cause)
+}
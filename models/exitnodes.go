@@ -5,90 +5,271 @@ import (
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
-	"math/rand"
+	"net/url"
 	"os"
+	"strings"
 )
 
+var ErrNoExitNodes = errors.New("no exitNodes available")
+var ErrExitNodeNotFound = errors.New("exitNode not found")
+var ErrExitNodeAmbiguous = errors.New("redacted key matches several exitNodes, use the full key")
+
 type ExitNode struct {
-	Interface  string `yaml:"interface"`
-	Region     string `yaml:"region"`
-	InstanceID string `yaml:"instance_id"`
-	Upstream   string `yaml:"upstream"`
+	Interface  string   `yaml:"interface" json:"interface,omitempty"`
+	Region     string   `yaml:"region" json:"region,omitempty"`
+	InstanceID string   `yaml:"instance_id" json:"instance_id,omitempty"`
+	Upstream   string   `yaml:"upstream" json:"upstream,omitempty"`
+	Weight     int      `yaml:"weight" json:"weight,omitempty"`
+	Bandwidth  ByteSize `yaml:"bandwidth" json:"bandwidth,omitempty"`
 }
 
-func (p *Proxy) ExitNodesFromDisk() {
-	if _, err := os.Stat(p.ExitNodesFile); errors.Is(err, os.ErrNotExist) {
-		log.Fatal().Err(err).Str("method", "ExitNodesFromDisk").Msg("no exitNodes file")
-	}
-
+func (p *Proxy) ExitNodesFromDisk() error {
 	b, err := os.ReadFile(p.ExitNodesFile)
 	if err != nil {
-		log.Fatal().Err(err).Str("method", "ExitNodesFromDisk").Msg("loading exitNodes file")
+		return fmt.Errorf("loading exitNodes file: %w", err)
 	}
 	var exitNodes []ExitNode
 	if err = yaml.Unmarshal(b, &exitNodes); err != nil {
-		log.Fatal().Err(err).Msg("can't parse exitNodes file")
+		return fmt.Errorf("can't parse exitNodes file: %w", err)
 	}
 
+	return p.updateExitNodes(func(_ []ExitNode) ([]ExitNode, error) {
+		return exitNodes, nil
+	})
+}
+
+func (p *Proxy) updateExitNodes(update func(current []ExitNode) ([]ExitNode, error)) error {
 	p.Mutex.Lock()
-	defer p.Mutex.Unlock()
-	p.ExitNodes.All = exitNodes
+	exitNodes, err := update(append([]ExitNode{}, p.configuredExitNodes...))
+	if err != nil {
+		p.Mutex.Unlock()
+		return err
+	}
+	p.configuredExitNodes = exitNodes
+	current := map[string]bool{}
 	for _, v := range exitNodes {
-		p.ExitNodes.ByRegion[v.Region] = append(p.ExitNodes.ByRegion[v.Region], v)
-		p.ExitNodes.ByInstanceID[v.InstanceID] = v
+		current[v.Key()] = true
 	}
-}
+	for key := range p.health {
+		if current[key] == false {
+			delete(p.health, key)
+		}
+	}
+	for key := range p.stats {
+		if current[key] == false {
+			delete(p.stats, key)
+		}
+	}
+	for key := range p.drained {
+		if current[key] == false {
+			delete(p.drained, key)
+		}
+	}
+	p.rebuildExitNodes()
+	p.Mutex.Unlock()
 
-func (p *Proxy) ByRegion(region string) (ExitNode, error) {
-	var err error
-	if _, ok := p.ExitNodes.ByRegion[region]; ok && len(p.ExitNodes.ByRegion[region]) > 0 {
-		slice := p.ExitNodes.ByRegion[region]
-		p.Mutex.Lock()
-		defer p.Mutex.Unlock()
-		if len(slice) >= 0 {
-			randomIndex := rand.Intn(len(slice))
-			return slice[randomIndex], nil
+	p.SessionMutex.Lock()
+	defer p.SessionMutex.Unlock()
+	for sessionKey, session := range p.Sessions {
+		if current[session.ExitNode.Key()] == false {
+			p.deleteSession(sessionKey)
 		}
-		err = errors.New("no exitNodes available")
 	}
-	return ExitNode{}, err
+	return nil
+}
+
+func (p *Proxy) AddExitNode(exitNode ExitNode) error {
+	return p.updateExitNodes(func(current []ExitNode) ([]ExitNode, error) {
+		for _, v := range current {
+			if v.Key() == exitNode.Key() {
+				return nil, fmt.Errorf("exitNode %s already exists", exitNode.RedactedKey())
+			}
+		}
+		return append(current, exitNode), nil
+	})
 }
 
-func (p *Proxy) BySession(userID string, session string) (ExitNode, error) {
-	var err error
-	sessionKey := fmt.Sprintf(`%s-%s`, userID, session)
-	if exitNode, ok := p.Sessions[sessionKey]; ok == true {
-		return exitNode, nil
+func (p *Proxy) RemoveExitNode(key string) error {
+	return p.updateExitNodes(func(current []ExitNode) ([]ExitNode, error) {
+		index, err := findExitNode(current, key)
+		if err != nil {
+			return nil, err
+		}
+		return append(current[:index], current[index+1:]...), nil
+	})
+}
+
+// the redacted key only matches when a single node has it
+func findExitNode(exitNodes []ExitNode, key string) (int, error) {
+	index := -1
+	for i, v := range exitNodes {
+		if v.Key() == key {
+			return i, nil
+		}
+		if v.RedactedKey() == key {
+			if index >= 0 {
+				return -1, ErrExitNodeAmbiguous
+			}
+			index = i
+		}
 	}
-	if exitNode, err := p.ByRandom(); err == nil {
-		p.Sessions[sessionKey] = exitNode
-		return exitNode, nil
+	if index < 0 {
+		return -1, ErrExitNodeNotFound
 	}
-	return ExitNode{}, err
+	return index, nil
 }
 
-func (p *Proxy) ByRandom() (exitNode ExitNode, err error) {
+func (p *Proxy) DrainExitNode(key string, drain bool) error {
 	p.Mutex.Lock()
 	defer p.Mutex.Unlock()
-	if len(p.ExitNodes.All) == 0 {
-		err = errors.New("no exitNodes available")
+	index, err := findExitNode(p.configuredExitNodes, key)
+	if err != nil {
+		return err
+	}
+	key = p.configuredExitNodes[index].Key()
+	if p.drained == nil {
+		p.drained = map[string]bool{}
+	}
+	if drain == true {
+		p.drained[key] = true
+	} else {
+		delete(p.drained, key)
+	}
+	p.rebuildExitNodes()
+	return nil
+}
+
+func (p *Proxy) ReloadExitNodes() {
+	if err := p.ExitNodesFromDisk(); err != nil {
+		log.Error().Err(err).Str("method", "ReloadExitNodes").Str("filename", p.ExitNodesFile).Msg("keeping previous exitNodes")
 		return
 	}
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	log.Info().Int("exitNodes", len(p.configuredExitNodes)).Int("available", len(p.ExitNodes.All)).Msg("exitNodes reloaded")
+}
 
-	randomIndex := rand.Intn(len(p.ExitNodes.All))
-	exitNode = p.ExitNodes.All[randomIndex]
+func (e ExitNode) Key() string {
+	return fmt.Sprintf(`%s|%s|%s`, e.InstanceID, e.Interface, e.Upstream)
+}
 
-	return
+func (e ExitNode) Redacted() ExitNode {
+	upstreamURL, err := url.Parse(e.Upstream)
+	if err == nil && upstreamURL.User != nil {
+		upstreamURL.User = url.User("xxxxx")
+		e.Upstream = upstreamURL.String()
+	}
+	return e
+}
+
+func (e ExitNode) RedactedKey() string {
+	return e.Redacted().Key()
+}
+
+func redactKey(key string) string {
+	parts := strings.SplitN(key, "|", 3)
+	if len(parts) < 3 {
+		return key
+	}
+	return ExitNode{InstanceID: parts[0], Interface: parts[1], Upstream: parts[2]}.RedactedKey()
+}
+
+// caller must hold Mutex
+func (p *Proxy) rebuildExitNodes() {
+	all := []ExitNode{}
+	byRegion := map[string][]ExitNode{}
+	byInstanceID := map[string]ExitNode{}
+	available := map[string]bool{}
+	for _, v := range p.configuredExitNodes {
+		if p.isHealthy(v) == false || p.drained[v.Key()] == true {
+			continue
+		}
+		available[v.Key()] = true
+		all = append(all, v)
+		byRegion[v.Region] = append(byRegion[v.Region], v)
+		byInstanceID[v.InstanceID] = v
+	}
+	p.ExitNodes.All = all
+	p.ExitNodes.ByRegion = byRegion
+	p.ExitNodes.ByInstanceID = byInstanceID
+	p.available = available
+}
+
+func (p *Proxy) isAvailable(exitNode ExitNode) bool {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	return p.available[exitNode.Key()]
+}
+
+func (p *Proxy) ByRegion(region string, strategy string, excluded map[string]bool) (ExitNode, error) {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	return p.pickExitNode(strategy, "region-"+region, p.ExitNodes.ByRegion[region], excluded)
+}
+
+func (p *Proxy) BySession(requestContext RequestContext, excluded map[string]bool) (ExitNode, error) {
+	sessionKey := fmt.Sprintf(`%s-%s-%s`, requestContext.UserID, requestContext.Region, requestContext.Session)
+	ttl := p.sessionTTL(requestContext)
+
+	p.SessionMutex.Lock()
+	session, ok := p.touchSession(sessionKey, ttl)
+	p.SessionMutex.Unlock()
+
+	// another instance or a previous run may have pinned the session
+	if ok == false {
+		if stored, storedNode, found := p.loadStoredExitNode(sessionKey); found && p.isAvailable(storedNode) {
+			p.SessionMutex.Lock()
+			session = p.storeSession(sessionKey, storedNode, ttl)
+			session.CreatedAt = stored.CreatedAt
+			p.SessionMutex.Unlock()
+			ok = true
+		}
+	}
+
+	if ok == true && p.isAvailable(session.ExitNode) {
+		if excluded[session.ExitNode.Key()] == false {
+			p.refreshStoredSession(sessionKey, session)
+			return session.ExitNode, nil
+		}
+		// a failed attempt keeps the pin, only this retry goes to another node
+		return p.bySessionRegion(requestContext, excluded)
+	}
+
+	exitNode, err := p.bySessionRegion(requestContext, excluded)
+	if err != nil {
+		return exitNode, err
+	}
+	p.SessionMutex.Lock()
+	session = p.storeSession(sessionKey, exitNode, ttl)
+	p.SessionMutex.Unlock()
+	p.refreshStoredSession(sessionKey, session)
+	return exitNode, nil
 }
 
-func (p *Proxy) ByInstanceID(id string) (exitNode ExitNode, err error) {
+func (p *Proxy) bySessionRegion(requestContext RequestContext, excluded map[string]bool) (ExitNode, error) {
+	if requestContext.Region != "" {
+		return p.ByRegion(requestContext.Region, requestContext.Strategy, excluded)
+	}
+	return p.ByRandom(requestContext.Strategy, excluded)
+}
+
+func (p *Proxy) ByRandom(strategy string, excluded map[string]bool) (ExitNode, error) {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	return p.pickExitNode(strategy, "all", p.ExitNodes.All, excluded)
+}
+
+func (p *Proxy) ByInstanceID(id string, excluded map[string]bool) (exitNode ExitNode, err error) {
 	p.Mutex.Lock()
 	defer p.Mutex.Unlock()
 	if len(p.ExitNodes.ByInstanceID) == 0 {
-		err = errors.New("no exitNodes available")
+		err = ErrNoExitNodes
 		return
 	}
 
 	exitNode = p.ExitNodes.ByInstanceID[id]
+	if excluded[exitNode.Key()] == true {
+		return ExitNode{}, ErrNoExitNodes
+	}
 	return
 }
@@ -0,0 +1,285 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// as in systemd socket activation
+const listenFdsStart = 3
+
+const (
+	readyFdEnv     = "MOXXI_READY_FD"
+	upgradeTimeout = time.Minute
+)
+
+// used when LISTEN_FDNAMES is missing, in the order of the socket unit
+var defaultListenerNames = []string{"proxy", "socks5", "admin", "prometheus"}
+
+var ErrUpgradeInProgress = errors.New("upgrade in progress")
+
+// LISTEN_PID is this process under systemd and unset after SIGUSR2
+func (p *Proxy) inheritListeners() error {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+		_ = os.Unsetenv(readyFdEnv)
+		_ = os.Unsetenv(stateFdEnv)
+	}()
+	p.listenerMutex.Lock()
+	defer p.listenerMutex.Unlock()
+	p.inherited = map[string]net.Listener{}
+
+	if fd, err := strconv.Atoi(os.Getenv(readyFdEnv)); err == nil {
+		p.readyFile = os.NewFile(uintptr(fd), "ready")
+	}
+	if fd, err := strconv.Atoi(os.Getenv(stateFdEnv)); err == nil {
+		p.stateFile = os.NewFile(uintptr(fd), "state")
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+
+	names := defaultListenerNames
+	if value := os.Getenv("LISTEN_FDNAMES"); value != "" {
+		names = strings.Split(value, ":")
+	}
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(listenFdsStart+i), fmt.Sprintf("listener-%d", i))
+		if i >= len(names) {
+			log.Warn().Int("fd", listenFdsStart+i).Msg("unnamed inherited socket")
+			_ = file.Close()
+			continue
+		}
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("inherited socket %s: %w", names[i], err)
+		}
+		p.inherited[names[i]] = listener
+		log.Info().Str("name", names[i]).Str("address", listener.Addr().String()).Msg("inherited socket")
+	}
+	return nil
+}
+
+func (p *Proxy) listen(name, address string) (net.Listener, error) {
+	p.listenerMutex.Lock()
+	defer p.listenerMutex.Unlock()
+	listener, ok := p.inherited[name]
+	if ok == true {
+		delete(p.inherited, name)
+	} else {
+		var err error
+		if listener, err = net.Listen("tcp", address); err != nil {
+			return nil, err
+		}
+	}
+	if p.listeners == nil {
+		p.listeners = map[string]net.Listener{}
+	}
+	p.listeners[name] = listener
+	return listener, nil
+}
+
+func (p *Proxy) closeUnusedListeners() {
+	p.listenerMutex.Lock()
+	defer p.listenerMutex.Unlock()
+	for name, listener := range p.inherited {
+		log.Warn().Str("name", name).Msg("closing unused inherited socket")
+		_ = listener.Close()
+	}
+	p.inherited = map[string]net.Listener{}
+}
+
+func (p *Proxy) closeListeners(names ...string) {
+	p.listenerMutex.Lock()
+	defer p.listenerMutex.Unlock()
+	for _, name := range names {
+		if listener, ok := p.listeners[name]; ok == true {
+			_ = listener.Close()
+		}
+	}
+}
+
+func (p *Proxy) notifyReady() {
+	if p.readyFile != nil {
+		_, _ = p.readyFile.Write([]byte{1})
+		_ = p.readyFile.Close()
+		p.readyFile = nil
+	}
+	if err := sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		log.Warn().Err(err).Msg("sd_notify")
+	}
+}
+
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func (p *Proxy) listenerFiles() ([]string, []*os.File, error) {
+	p.listenerMutex.Lock()
+	defer p.listenerMutex.Unlock()
+	var names []string
+	var files []*os.File
+	for _, name := range defaultListenerNames {
+		listener, ok := p.listeners[name]
+		if ok == false {
+			continue
+		}
+		file, err := dupListener(name, listener)
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("socket %s: %w", name, err)
+		}
+		names = append(names, name)
+		files = append(files, file)
+	}
+	return names, files, nil
+}
+
+// Fd on a TCPListener.File copy turns the shared descriptor blocking and Close could no longer interrupt Accept
+func dupListener(name string, listener net.Listener) (*os.File, error) {
+	conn, ok := listener.(syscall.Conn)
+	if ok == false {
+		return nil, errors.New("not a socket")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	fd, dupErr := -1, error(nil)
+	err = raw.Control(func(sysfd uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, dupErr = syscall.Dup(int(sysfd)); dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		_ = file.Close()
+	}
+}
+
+// the sockets are shared so no connection is refused in between
+func (p *Proxy) Upgrade() error {
+	if p.ShuttingDown() == true || atomic.CompareAndSwapInt32(&p.upgrading, 0, 1) == false {
+		return ErrUpgradeInProgress
+	}
+	defer atomic.StoreInt32(&p.upgrading, 0)
+
+	executable, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	names, files, err := p.listenerFiles()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		_ = readyWriter.Close()
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter, stateReader)
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, "LISTEN_") == false && strings.HasPrefix(env, readyFdEnv+"=") == false &&
+			strings.HasPrefix(env, stateFdEnv+"=") == false {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		readyFdEnv+"="+strconv.Itoa(listenFdsStart+len(files)),
+		stateFdEnv+"="+strconv.Itoa(listenFdsStart+len(files)+1),
+	)
+
+	// only the new process writes the quota and session files from the snapshot on
+	state := p.handOffState()
+	err = cmd.Start()
+	_ = readyWriter.Close()
+	_ = stateReader.Close()
+	if err != nil {
+		_ = stateWriter.Close()
+		p.cancelHandOff()
+		return err
+	}
+	log.Info().Str("executable", executable).Int("pid", cmd.Process.Pid).Msg("upgrading")
+	go func() {
+		if err := json.NewEncoder(stateWriter).Encode(state); err != nil {
+			log.Warn().Err(err).Msg("can't send state to the new process")
+		}
+	}()
+
+	// the pipe ends without a byte when the new process exits before serving
+	readyDone := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := ready.Read(buf)
+		readyDone <- n == 1
+	}()
+	select {
+	case ok := <-readyDone:
+		if ok == false {
+			_ = stateWriter.Close()
+			_ = cmd.Wait()
+			p.cancelHandOff()
+			return fmt.Errorf("new process exited: %s", cmd.ProcessState)
+		}
+	case <-time.After(upgradeTimeout):
+		_ = stateWriter.Close()
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		p.cancelHandOff()
+		return errors.New("new process not ready in time")
+	}
+
+	log.Info().Int("pid", cmd.Process.Pid).Msg("new process ready")
+	p.stateWriter = stateWriter
+	go p.Shutdown()
+	return nil
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"io"
+)
+
+const stateFdEnv = "MOXXI_STATE_FD"
+
+// only the new process writes the files once the snapshot is sent
+type handoffState struct {
+	Quotas     map[string]quotaUsage    `json:"quotas,omitempty"`
+	QuotaDelta map[string]int64         `json:"quota_delta,omitempty"`
+	Sessions   map[string]StoredSession `json:"sessions,omitempty"`
+}
+
+// Redis is shared and needs no handoff
+func (p *Proxy) fileSessionStore() *FileSessionStore {
+	store, _ := p.SessionStore.(*FileSessionStore)
+	return store
+}
+
+func (p *Proxy) handOffState() handoffState {
+	state := handoffState{}
+	if p.Quotas != nil {
+		state.Quotas = p.Quotas.handOff()
+	}
+	if store := p.fileSessionStore(); store != nil {
+		state.Sessions = store.handOff()
+	}
+	return state
+}
+
+func (p *Proxy) cancelHandOff() {
+	if p.Quotas != nil {
+		p.Quotas.cancelHandOff()
+	}
+	if store := p.fileSessionStore(); store != nil {
+		store.cancelHandOff()
+	}
+}
+
+func (p *Proxy) sendDrainedState() {
+	state := handoffState{}
+	if p.Quotas != nil {
+		state.QuotaDelta = p.Quotas.handOffDelta()
+	}
+	if store := p.fileSessionStore(); store != nil {
+		state.Sessions = store.handOff()
+	}
+	err := json.NewEncoder(p.stateWriter).Encode(state)
+	_ = p.stateWriter.Close()
+	if err != nil {
+		log.Warn().Err(err).Msg("can't send state to the new process")
+	}
+}
+
+func (p *Proxy) receiveState() {
+	if p.stateFile == nil {
+		return
+	}
+	decoder := json.NewDecoder(p.stateFile)
+	state := handoffState{}
+	if err := decoder.Decode(&state); err != nil {
+		log.Warn().Err(err).Msg("no state from the previous process")
+		_ = p.stateFile.Close()
+		return
+	}
+	p.applyState(state, true)
+
+	go func() {
+		defer p.stateFile.Close()
+		for {
+			state := handoffState{}
+			if err := decoder.Decode(&state); err != nil {
+				if err != io.EOF {
+					log.Warn().Err(err).Msg("can't read state from the previous process")
+				}
+				return
+			}
+			p.applyState(state, false)
+		}
+	}()
+}
+
+func (p *Proxy) applyState(state handoffState, snapshot bool) {
+	if p.Quotas != nil {
+		if snapshot == true {
+			p.Quotas.restore(state.Quotas)
+		}
+		for key, bytes := range state.QuotaDelta {
+			p.Quotas.Add(key, bytes)
+		}
+	}
+	if store := p.fileSessionStore(); store != nil {
+		store.restore(state.Sessions, snapshot)
+	}
+	log.Info().Bool("snapshot", snapshot).Int("quotas", len(state.Quotas)+len(state.QuotaDelta)).
+		Int("sessions", len(state.Sessions)).Msg("state from the previous process")
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sync"
+	"time"
+)
+
+type exitNodeHealth struct {
+	Failures int
+	Healthy  bool
+}
+
+// caller must hold Mutex
+func (p *Proxy) isHealthy(exitNode ExitNode) bool {
+	if state, ok := p.health[exitNode.Key()]; ok {
+		return state.Healthy
+	}
+	return true
+}
+
+func (p *Proxy) RunHealthChecks() {
+	p.Mutex.Lock()
+	if p.health == nil {
+		p.health = map[string]*exitNodeHealth{}
+	}
+	p.Mutex.Unlock()
+
+	ticker := time.NewTicker(time.Duration(p.HealthCheckInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		p.checkExitNodes()
+		<-ticker.C
+	}
+}
+
+func (p *Proxy) checkExitNodes() {
+	p.Mutex.Lock()
+	exitNodes := p.configuredExitNodes
+	p.Mutex.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, exitNode := range exitNodes {
+		wg.Add(1)
+		go func(exitNode ExitNode) {
+			defer wg.Done()
+			p.recordProbe(exitNode, p.probeExitNode(exitNode))
+		}(exitNode)
+	}
+	wg.Wait()
+}
+
+func (p *Proxy) probeExitNode(exitNode ExitNode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.upstreamTimeout())
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err = p.dialExitNodeGuarded(exitNode, RequestContext{}, p.HealthCheckTarget, false)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		go func() {
+			<-done
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}()
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *Proxy) recordProbe(exitNode ExitNode, probeErr error) {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+
+	state, ok := p.health[exitNode.Key()]
+	if !ok {
+		state = &exitNodeHealth{Healthy: true}
+		p.health[exitNode.Key()] = state
+	}
+
+	wasHealthy := state.Healthy
+	if probeErr != nil {
+		state.Failures++
+		if state.Failures >= p.HealthCheckFailures {
+			state.Healthy = false
+		}
+		log.Debug().Err(probeErr).Str("exitNode", exitNode.RedactedKey()).Int("failures", state.Failures).Msg("health check failed")
+	} else {
+		state.Failures = 0
+		state.Healthy = true
+	}
+	p.LogHealth(exitNode, state.Healthy, probeErr != nil)
+
+	if wasHealthy != state.Healthy {
+		log.Info().Str("exitNode", exitNode.RedactedKey()).Bool("healthy", state.Healthy).Msg("exit node health changed")
+		p.rebuildExitNodes()
+	}
+}
@@ -2,6 +2,9 @@ package models
 
 import (
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 )
 
 func copyHeader(dest, src http.Header) {
@@ -11,3 +14,28 @@ func copyHeader(dest, src http.Header) {
 		}
 	}
 }
+
+// scheme://./path keeps the path relative
+func urlFilename(fileURL *url.URL) string {
+	if fileURL.Host != "" {
+		return fileURL.Host + fileURL.Path
+	}
+	return fileURL.Path
+}
+
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+	"sync"
+)
+
+type HtpasswdAuthenticator struct {
+	filename string
+	mutex    sync.RWMutex
+	hashes   map[string]string
+}
+
+func NewHtpasswdAuthenticator(filename string) (*HtpasswdAuthenticator, error) {
+	htpasswd := &HtpasswdAuthenticator{filename: filename}
+	if err := htpasswd.Load(); err != nil {
+		return nil, err
+	}
+	if err := WatchFile(filename, htpasswd.Reload); err != nil {
+		log.Warn().Err(err).Str("filename", filename).Msg("can't watch htpasswd file")
+	}
+	return htpasswd, nil
+}
+
+func (h *HtpasswdAuthenticator) Load() error {
+	data, err := os.ReadFile(h.filename)
+	if err != nil {
+		return err
+	}
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if ok == false {
+			continue
+		}
+		if strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "$1$") {
+			log.Warn().Str("username", username).Str("filename", h.filename).Msg("md5 htpasswd entries are not supported, use htpasswd -B")
+			continue
+		}
+		hashes[username] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	h.hashes = hashes
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *HtpasswdAuthenticator) Reload() {
+	if err := h.Load(); err != nil {
+		log.Error().Err(err).Str("method", "HtpasswdAuthenticator.Reload").Str("filename", h.filename).Msg("keeping previous users")
+		return
+	}
+	log.Info().Str("filename", h.filename).Msg("htpasswd reloaded")
+}
+
+func (h *HtpasswdAuthenticator) Authenticate(username string, password string, _ RequestContext) (User, bool, error) {
+	h.mutex.RLock()
+	hash, ok := h.hashes[username]
+	h.mutex.RUnlock()
+	if ok == false {
+		return User{}, false, nil
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return User{}, subtle.ConstantTimeCompare([]byte(encoded), []byte(strings.TrimPrefix(hash, "{SHA}"))) == 1, nil
+	}
+	verified, err := verifyPassword(hash, password)
+	return User{}, verified, err
+}
+
+func (h *HtpasswdAuthenticator) Enabled() bool {
+	return true
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+type ipUser struct {
+	prefix   netip.Prefix
+	username string
+}
+
+// most specific network first, guarded by userMutex
+var ipUsers []ipUser
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parseRemoteAddr(remoteAddress string) (netip.Addr, bool) {
+	host := remoteAddress
+	if h, _, err := net.SplitHostPort(remoteAddress); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func indexIPs(users map[string]User) []ipUser {
+	var index []ipUser
+	for username, user := range users {
+		for _, v := range user.IPs {
+			prefix, err := parsePrefix(v)
+			if err != nil {
+				log.Warn().Err(err).Str("username", username).Str("ip", v).Msg("Users.Load.IPs")
+				continue
+			}
+			index = append(index, ipUser{prefix: prefix, username: username})
+		}
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		if index[i].prefix.Bits() != index[j].prefix.Bits() {
+			return index[i].prefix.Bits() > index[j].prefix.Bits()
+		}
+		return index[i].username < index[j].username
+	})
+	return index
+}
+
+func lookupIPUser(remoteAddress string) (string, User, bool) {
+	addr, ok := parseRemoteAddr(remoteAddress)
+	if ok == false {
+		return "", User{}, false
+	}
+	userMutex.RLock()
+	defer userMutex.RUnlock()
+	for _, v := range ipUsers {
+		if v.prefix.Contains(addr) {
+			user, ok := userMap[v.username]
+			return v.username, user, ok
+		}
+	}
+	return "", User{}, false
+}
+
+func (rc *RequestContext) FromAddress(remoteAddress string) bool {
+	username, user, ok := lookupIPUser(remoteAddress)
+	if ok == false {
+		return false
+	}
+	*rc = RequestContext{
+		UserID:        username,
+		RawUsername:   username,
+		Authenticated: true,
+		User:          user,
+	}
+	rc.authorize()
+	log.Trace().Str("UserID", username).Str("address", remoteAddress).Msg("authenticated by address")
+	return true
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{" 192.168.1.1 ", "192.168.1.1/32", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"2001:db8::1/32", "2001:db8::/32", false},
+		{"::ffff:10.0.0.1", "10.0.0.1/32", false},
+		{"10.0.0.0/33", "", true},
+		{"example.com", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		prefix, err := parsePrefix(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePrefix(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr == false && prefix.String() != tt.want {
+			t.Errorf("parsePrefix(%q) = %s, want %s", tt.value, prefix, tt.want)
+		}
+	}
+}
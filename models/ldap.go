@@ -0,0 +1,66 @@
+package models
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ldapTimeout = 5 * time.Second
+
+type LDAPAuthenticator struct {
+	address    string
+	host       string
+	dnTemplate string
+	startTLS   bool
+}
+
+func NewLDAPAuthenticator(ldapURL *url.URL) (*LDAPAuthenticator, error) {
+	query := ldapURL.Query()
+	dnTemplate := query.Get("dn")
+	if strings.Count(dnTemplate, "%s") != 1 {
+		return nil, fmt.Errorf("ldap dn template must contain %%s once, got %q", dnTemplate)
+	}
+	address := &url.URL{Scheme: ldapURL.Scheme, Host: ldapURL.Host}
+	return &LDAPAuthenticator{
+		address:    address.String(),
+		host:       ldapURL.Hostname(),
+		dnTemplate: dnTemplate,
+		startTLS:   query.Get("starttls") == "true",
+	}, nil
+}
+
+func (l *LDAPAuthenticator) Authenticate(username string, password string, _ RequestContext) (User, bool, error) {
+	// an empty password is an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return User{}, false, nil
+	}
+	conn, err := ldap.DialURL(l.address, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return User{}, false, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	if l.startTLS == true {
+		if err = conn.StartTLS(&tls.Config{ServerName: l.host}); err != nil {
+			return User{}, false, err
+		}
+	}
+
+	err = conn.Bind(fmt.Sprintf(l.dnTemplate, ldap.EscapeDN(username)), password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, err
+	}
+	return User{}, true, nil
+}
+
+func (l *LDAPAuthenticator) Enabled() bool {
+	return true
+}
@@ -40,6 +40,84 @@ var vecTXBytes = promauto.NewCounterVec(
 	vecFields,
 )
 
+var exitNodeFields = []string{
+	"instance_id",
+	"region",
+	"backend",
+}
+
+var vecExitNodeHealthy = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "moxxi_exitnode_healthy",
+		Help: "Whether the exit node passed its last health checks",
+	},
+	exitNodeFields,
+)
+var vecExitNodeProbeFailures = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "moxxi_exitnode_probe_failures",
+		Help: "The total failed health check probes",
+	},
+	exitNodeFields,
+)
+
+var vecUserConnections = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "moxxi_user_connections",
+		Help: "The open tunnels and requests per user",
+	},
+	[]string{"user_id"},
+)
+var vecRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "moxxi_rejections",
+		Help: "The total requests rejected by a limit",
+	},
+	[]string{"user_id", "reason"},
+)
+
+func (p *Proxy) LogUserConnections(userID string, connections int64) {
+	if p.MetricsLogger != "prometheus" {
+		return
+	}
+	vecUserConnections.With(prometheus.Labels{"user_id": userID}).Set(float64(connections))
+}
+
+func (p *Proxy) LogRejection(requestContext RequestContext, reason string) {
+	log.Debug().Str("UserID", requestContext.UserID).Str("reason", reason).Msg("rejected")
+	if p.MetricsLogger != "prometheus" {
+		return
+	}
+	vecRejections.With(prometheus.Labels{"user_id": requestContext.UserID, "reason": reason}).Inc()
+}
+
+func (p *Proxy) LogHealth(exitNode ExitNode, healthy bool, probeFailed bool) {
+	if p.MetricsLogger != "prometheus" {
+		return
+	}
+	backend := exitNode.Interface
+	if p.IsUpstream == true {
+		// never leak upstream credentials into labels
+		backend = exitNode.Upstream
+		if upstreamURL, err := parseUpstream(exitNode.Upstream); err == nil {
+			backend = upstreamURL.Host
+		}
+	}
+	labels := prometheus.Labels{
+		"instance_id": exitNode.InstanceID,
+		"region":      exitNode.Region,
+		"backend":     backend,
+	}
+	value := 0.0
+	if healthy == true {
+		value = 1
+	}
+	vecExitNodeHealthy.With(labels).Set(value)
+	if probeFailed == true {
+		vecExitNodeProbeFailures.With(labels).Inc()
+	}
+}
+
 func (p *Proxy) LogPayload(payload MetricPayload) {
 	if hostParts := strings.Split(payload.Host, ":"); len(hostParts) > 0 {
 		payload.Host = hostParts[0]
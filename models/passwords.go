@@ -0,0 +1,170 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PasswordBcrypt   = "bcrypt"
+	PasswordArgon2id = "argon2id"
+	passwordPlain    = "plain"
+
+	argon2idMemory  = 64 * 1024
+	argon2idTime    = 3
+	argon2idThreads = 2
+	argon2idKeyLen  = 32
+	argon2idSaltLen = 16
+
+	verifiedPasswordsMax = 10000
+
+	hashSlotWait = time.Second
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+var ErrPasswordCheckBusy = errors.New("too many password checks")
+
+// bcrypt and argon2id only run once per password
+var verifiedPasswords = map[[sha256.Size]byte]bool{}
+var verifiedMutex sync.Mutex
+
+// keyed so a memory dump doesn't give away cheap hashes of the passwords
+var credentialKey = randomKey()
+
+// every wrong password runs a hash and argon2id takes 64 MiB
+var hashSlots = make(chan struct{}, runtime.NumCPU())
+
+func randomKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func credentialHash(values ...string) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	mac := hmac.New(sha256.New, credentialKey)
+	mac.Write([]byte(strings.Join(values, "\x00")))
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+func passwordScheme(stored string) string {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return PasswordBcrypt
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return PasswordArgon2id
+	}
+	return passwordPlain
+}
+
+func HashPassword(password string, algorithm string) (string, error) {
+	switch algorithm {
+	case PasswordBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case PasswordArgon2id:
+		salt := make([]byte, argon2idSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2idMemory, argon2idTime, argon2idThreads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+	return "", fmt.Errorf("unknown algorithm %q, use %s or %s", algorithm, PasswordBcrypt, PasswordArgon2id)
+}
+
+func validatePassword(stored string) error {
+	switch passwordScheme(stored) {
+	case PasswordBcrypt:
+		_, err := bcrypt.Cost([]byte(stored))
+		return err
+	case PasswordArgon2id:
+		_, _, _, _, _, err := parseArgon2id(stored)
+		return err
+	}
+	return nil
+}
+
+// $argon2id$v=19$m=65536,t=3,p=2$salt$key
+func parseArgon2id(stored string) (memory uint32, time uint32, threads uint8, salt []byte, key []byte, err error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return 0, 0, 0, nil, nil, ErrInvalidPasswordHash
+	}
+	return memory, time, threads, salt, key, nil
+}
+
+func verifyPassword(stored string, password string) (bool, error) {
+	scheme := passwordScheme(stored)
+	if scheme == passwordPlain {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, nil
+	}
+
+	cacheKey := credentialHash(stored, password)
+	verifiedMutex.Lock()
+	verified := verifiedPasswords[cacheKey]
+	verifiedMutex.Unlock()
+	if verified == true {
+		return true, nil
+	}
+
+	timer := time.NewTimer(hashSlotWait)
+	defer timer.Stop()
+	select {
+	case hashSlots <- struct{}{}:
+	case <-timer.C:
+		return false, ErrPasswordCheckBusy
+	}
+	defer func() { <-hashSlots }()
+	switch scheme {
+	case PasswordBcrypt:
+		verified = bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case PasswordArgon2id:
+		memory, time, threads, salt, key, err := parseArgon2id(stored)
+		if err != nil {
+			return false, nil
+		}
+		computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+		verified = subtle.ConstantTimeCompare(computed, key) == 1
+	}
+	if verified == true {
+		verifiedMutex.Lock()
+		if len(verifiedPasswords) >= verifiedPasswordsMax {
+			verifiedPasswords = map[[sha256.Size]byte]bool{}
+		}
+		verifiedPasswords[cacheKey] = true
+		verifiedMutex.Unlock()
+	}
+	return verified, nil
+}
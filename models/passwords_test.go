@@ -0,0 +1,78 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []string{PasswordBcrypt, PasswordArgon2id} {
+		stored, err := HashPassword("s3cret", algorithm)
+		if err != nil {
+			t.Fatalf("HashPassword(%s): %v", algorithm, err)
+		}
+		if scheme := passwordScheme(stored); scheme != algorithm {
+			t.Errorf("HashPassword(%s) scheme = %s", algorithm, scheme)
+		}
+		if err = validatePassword(stored); err != nil {
+			t.Errorf("validatePassword(%s hash): %v", algorithm, err)
+		}
+	}
+	if _, err := HashPassword("s3cret", "md5"); err == nil {
+		t.Error("HashPassword(md5) accepted an unknown algorithm")
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := HashPassword("s3cret", PasswordBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2idHash, err := HashPassword("s3cret", PasswordArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{"plain", "s3cret", "s3cret", true},
+		{"plain wrong", "s3cret", "secret", false},
+		{"plain empty", "s3cret", "", false},
+		{"bcrypt", bcryptHash, "s3cret", true},
+		{"bcrypt cached", bcryptHash, "s3cret", true},
+		{"bcrypt wrong", bcryptHash, "secret", false},
+		{"argon2id", argon2idHash, "s3cret", true},
+		{"argon2id wrong", argon2idHash, "secret", false},
+		{"argon2id malformed", "$argon2id$v=19$m=65536$salt$key", "s3cret", false},
+	}
+	for _, tt := range tests {
+		got, err := verifyPassword(tt.stored, tt.password)
+		if err != nil {
+			t.Errorf("%s: verifyPassword: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: verifyPassword = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		stored  string
+		wantErr bool
+	}{
+		{"plaintext", false},
+		{"$2b$10$invalid", true},
+		{"$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$", true},
+		{"$argon2id$v=18$m=65536,t=3,p=2$c2FsdA$a2V5", true},
+		{"$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$a2V5", false},
+	}
+	for _, tt := range tests {
+		if err := validatePassword(tt.stored); (err != nil) != tt.wantErr {
+			t.Errorf("validatePassword(%q) error = %v, wantErr %v", tt.stored, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const quotaFlushInterval = 30 * time.Second
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", value)
+	}
+	return ByteSize(number * float64(multiplier)), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(raw)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	switch value := raw.(type) {
+	case float64:
+		if value < 0 {
+			return fmt.Errorf("invalid byte size %v", value)
+		}
+		*b = ByteSize(value)
+	case string:
+		size, err := ParseByteSize(value)
+		if err != nil {
+			return err
+		}
+		*b = size
+	case nil:
+		*b = 0
+	default:
+		return fmt.Errorf("invalid byte size %s", data)
+	}
+	return nil
+}
+
+type Quota struct {
+	Daily   ByteSize `yaml:"daily" json:"daily,omitempty"`
+	Monthly ByteSize `yaml:"monthly" json:"monthly,omitempty"`
+}
+
+func (q Quota) isSet() bool {
+	return q.Daily > 0 || q.Monthly > 0
+}
+
+type quotaUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+func (u *quotaUsage) roll(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	month := now.UTC().Format("2006-01")
+	if u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if u.Month != month {
+		u.Month = month
+		u.MonthBytes = 0
+	}
+}
+
+type QuotaTracker struct {
+	filename string
+	mutex    sync.Mutex
+	usage    map[string]*quotaUsage
+	dirty    bool
+	// usage added since the state went to a new process, Flush is off while set
+	handoff map[string]int64
+	done    chan struct{}
+}
+
+func NewQuotaTracker(filename string) (*QuotaTracker, error) {
+	tracker := &QuotaTracker{
+		filename: filename,
+		usage:    map[string]*quotaUsage{},
+		done:     make(chan struct{}),
+	}
+	if filename == "" {
+		return tracker, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil && os.IsNotExist(err) == false {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &tracker.usage); err != nil {
+			return nil, fmt.Errorf("can't parse quota file: %w", err)
+		}
+	}
+	go tracker.flushLoop()
+	return tracker, nil
+}
+
+func (t *QuotaTracker) Add(key string, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	usage, ok := t.usage[key]
+	if !ok {
+		usage = &quotaUsage{}
+		t.usage[key] = usage
+	}
+	usage.roll(time.Now())
+	usage.DayBytes += bytes
+	usage.MonthBytes += bytes
+	t.dirty = true
+	if t.handoff != nil {
+		t.handoff[key] += bytes
+	}
+}
+
+func (t *QuotaTracker) Exceeded(key string, quota Quota) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	usage, ok := t.usage[key]
+	if !ok {
+		return false
+	}
+	usage.roll(time.Now())
+	return (quota.Daily > 0 && usage.DayBytes >= int64(quota.Daily)) ||
+		(quota.Monthly > 0 && usage.MonthBytes >= int64(quota.Monthly))
+}
+
+func (t *QuotaTracker) Flush() error {
+	if t.filename == "" {
+		return nil
+	}
+	t.mutex.Lock()
+	if t.dirty == false || t.handoff != nil {
+		t.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(t.usage)
+	t.dirty = false
+	t.mutex.Unlock()
+	if err == nil {
+		err = writeFileAtomic(t.filename, data)
+	}
+	if err != nil {
+		t.mutex.Lock()
+		t.dirty = true
+		t.mutex.Unlock()
+	}
+	return err
+}
+
+func (t *QuotaTracker) handOff() map[string]quotaUsage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	snapshot := make(map[string]quotaUsage, len(t.usage))
+	for key, usage := range t.usage {
+		snapshot[key] = *usage
+	}
+	t.handoff = map[string]int64{}
+	return snapshot
+}
+
+func (t *QuotaTracker) handOffDelta() map[string]int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delta := t.handoff
+	t.handoff = map[string]int64{}
+	return delta
+}
+
+// the usage never left this process
+func (t *QuotaTracker) cancelHandOff() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.handoff = nil
+}
+
+func (t *QuotaTracker) restore(snapshot map[string]quotaUsage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.usage = make(map[string]*quotaUsage, len(snapshot))
+	for key, usage := range snapshot {
+		usage := usage
+		t.usage[key] = &usage
+	}
+	t.dirty = true
+}
+
+func (t *QuotaTracker) Close() error {
+	close(t.done)
+	return t.Flush()
+}
+
+func (t *QuotaTracker) flushLoop() {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Flush(); err != nil {
+				log.Warn().Err(err).Str("filename", t.filename).Msg("QuotaTracker.Flush")
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (p *Proxy) quotas(requestContext RequestContext) map[string]Quota {
+	if p.Quotas == nil || requestContext.UserID == "" {
+		return nil
+	}
+	user := requestContext.User
+	quotas := map[string]Quota{}
+	if user.Quota.isSet() {
+		quotas[requestContext.UserID] = user.Quota
+	}
+	if projectQuota, ok := user.ProjectQuotas[requestContext.Project]; ok && requestContext.Project != "" && projectQuota.isSet() {
+		quotas[requestContext.UserID+"/"+requestContext.Project] = projectQuota
+	}
+	return quotas
+}
+
+func (p *Proxy) quotaExceeded(requestContext RequestContext) bool {
+	for key, quota := range p.quotas(requestContext) {
+		if p.Quotas.Exceeded(key, quota) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) addQuotaUsage(requestContext RequestContext, bytes int64) {
+	for key := range p.quotas(requestContext) {
+		p.Quotas.Add(key, bytes)
+	}
+}
+
+type quotaWriter struct {
+	writer         io.Writer
+	proxy          *Proxy
+	requestContext RequestContext
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	w.proxy.addQuotaUsage(w.requestContext, int64(n))
+	if err == nil && w.proxy.quotaExceeded(w.requestContext) {
+		err = ErrQuotaExceeded
+	}
+	return n, err
+}
+
+// the rest keep io.Copy's zero-copy paths
+func (p *Proxy) quotaWrap(writer io.Writer, requestContext RequestContext) io.Writer {
+	if len(p.quotas(requestContext)) == 0 {
+		return writer
+	}
+	return &quotaWriter{
+		writer:         writer,
+		proxy:          p,
+		requestContext: requestContext,
+	}
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+const rateLimitPruneInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	burst := math.Max(1, math.Ceil(rate))
+	return &tokenBucket{
+		tokens: burst,
+		last:   now,
+		rate:   rate,
+		burst:  burst,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+func (p *Proxy) rateLimits(requestContext RequestContext) (float64, float64) {
+	userRate, hostRate := p.RateLimitPerUser, p.HostRateLimitPerUser
+	if requestContext.User.RateLimit > 0 {
+		userRate = requestContext.User.RateLimit
+	}
+	if requestContext.User.HostRateLimit > 0 {
+		hostRate = requestContext.User.HostRateLimit
+	}
+	return userRate, hostRate
+}
+
+func (p *Proxy) allowRequest(requestContext RequestContext, host string) (bool, time.Duration) {
+	if requestContext.UserID == "" {
+		return true, 0
+	}
+	userRate, hostRate := p.rateLimits(requestContext)
+	if userRate <= 0 && hostRate <= 0 {
+		return true, 0
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	now := time.Now()
+	p.rateMutex.Lock()
+	defer p.rateMutex.Unlock()
+	if p.rateBuckets == nil {
+		p.rateBuckets = map[string]*tokenBucket{}
+	}
+	p.pruneRateBuckets(now)
+
+	// a rejected host doesn't spend a token of the user
+	if hostRate > 0 {
+		if ok, wait := p.rateBucket(requestContext.UserID+"|"+host, hostRate, now).take(now); !ok {
+			p.LogRejection(requestContext, "host_rate")
+			return false, wait
+		}
+	}
+	if userRate > 0 {
+		if ok, wait := p.rateBucket(requestContext.UserID, userRate, now).take(now); !ok {
+			p.LogRejection(requestContext, "rate")
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// caller must hold rateMutex
+func (p *Proxy) rateBucket(key string, rate float64, now time.Time) *tokenBucket {
+	bucket, ok := p.rateBuckets[key]
+	if !ok || bucket.rate != rate {
+		bucket = newTokenBucket(rate, now)
+		p.rateBuckets[key] = bucket
+	}
+	return bucket
+}
+
+// full buckets behave like new ones, caller must hold rateMutex
+func (p *Proxy) pruneRateBuckets(now time.Time) {
+	if now.Sub(p.rateBucketsPruned) < rateLimitPruneInterval {
+		return
+	}
+	p.rateBucketsPruned = now
+	for key, bucket := range p.rateBuckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(p.rateBuckets, key)
+		}
+	}
+}
+
+func retryAfter(wait time.Duration) int {
+	return int(math.Max(1, math.Ceil(wait.Seconds())))
+}
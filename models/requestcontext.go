@@ -2,10 +2,12 @@ package models
 
 import (
 	"encoding/base64"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"net/http"
 
 	"strings"
+	"time"
 )
 
 type RequestContext struct {
@@ -16,11 +18,16 @@ type RequestContext struct {
 	Project       string
 	Session       string
 	Instance      string
+	Strategy      string
+	SessionTTL    time.Duration
 	Authenticated bool
+	User          User
+	Forbidden     string
+	Busy          bool
 }
 
 func (rc *RequestContext) FromRequest(request *http.Request) {
-	if len(UserMap) == 0 {
+	if authenticationEnabled() == false {
 		rc.Authenticated = true
 	}
 
@@ -33,15 +40,52 @@ func (rc *RequestContext) FromRequest(request *http.Request) {
 			log.Err(err).Str("method", "FromRequest").Str("Header", authHeader).Msg("decoding auth header")
 		}
 		if userParts := strings.Split(string(data), ":"); len(userParts) > 1 {
+			rc.FromCredentials(userParts[0], userParts[1])
 			rc.RawCreds = authHeader
-			rc.RawUsername = userParts[0]
-			authToken := userParts[1]
-			rc.ParseUsername(rc.RawUsername)
-			if password, ok := UserMap[rc.UserID]; ok == true && authToken == password {
-				rc.Authenticated = true
-			}
 		}
 	}
+	// mapped clients can still send credentials to pick another user or routing tokens
+	if rc.Authenticated == false {
+		rc.FromAddress(request.RemoteAddr)
+	}
+}
+
+func (rc *RequestContext) FromCredentials(username string, authToken string) {
+	if authenticationEnabled() == false {
+		rc.Authenticated = true
+	}
+
+	rc.RawCreds = base64.StdEncoding.EncodeToString([]byte(username + ":" + authToken))
+	rc.RawUsername = username
+	rc.ParseUsername(rc.RawUsername)
+	user, ok, err := authenticate(rc.UserID, authToken, *rc)
+	if ok == false {
+		rc.Busy = errors.Is(err, ErrPasswordCheckBusy)
+		return
+	}
+	rc.Authenticated = true
+	rc.User = user
+	rc.authorize()
+}
+
+// instances are checked by instanceRejection
+func (rc *RequestContext) authorize() {
+	user := rc.User
+	if rc.Region == "" && rc.Instance == "" {
+		rc.Region = user.Region
+	}
+	if rc.Project == "" {
+		rc.Project = user.Project
+	}
+	// the strategy token only applies to users without a strategy of their own
+	if user.Strategy != "" {
+		rc.Strategy = user.Strategy
+	}
+	if user.active(time.Now()) == false {
+		rc.Forbidden = causeUserInactive
+	} else if rc.Region != "" && user.restricted() && contains(user.Regions, rc.Region) == false {
+		rc.Forbidden = causeRegionNotAllowed
+	}
 }
 
 func (rc *RequestContext) ParseUsername(userRaw string) {
@@ -59,6 +103,12 @@ func (rc *RequestContext) ParseUsername(userRaw string) {
 				rc.Session = kv[1]
 			} else if kv[0] == "instance" {
 				rc.Instance = kv[1]
+			} else if kv[0] == "strategy" && ValidStrategy(kv[1]) {
+				rc.Strategy = kv[1]
+			} else if kv[0] == "ttl" {
+				if ttl, err := time.ParseDuration(kv[1]); err == nil && ttl > 0 {
+					rc.SessionTTL = ttl
+				}
 			}
 		}
 	}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseUsername(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want RequestContext
+	}{
+		{"alice", RequestContext{UserID: "alice"}},
+		{"alice_region-us", RequestContext{UserID: "alice", Region: "us"}},
+		{"alice_project-p1_region-eu_session-abc_instance-i1",
+			RequestContext{UserID: "alice", Project: "p1", Region: "eu", Session: "abc", Instance: "i1"}},
+		{"alice_strategy-roundrobin", RequestContext{UserID: "alice", Strategy: StrategyRoundRobin}},
+		{"alice_strategy-fastest", RequestContext{UserID: "alice"}},
+		{"alice_session-s1_ttl-10m", RequestContext{UserID: "alice", Session: "s1", SessionTTL: 10 * time.Minute}},
+		{"alice_ttl-soon", RequestContext{UserID: "alice"}},
+		{"alice_ttl--5m", RequestContext{UserID: "alice"}},
+		{"alice_region", RequestContext{UserID: "alice"}},
+		{"alice_color-red", RequestContext{UserID: "alice"}},
+		{"", RequestContext{}},
+	}
+	for _, tt := range tests {
+		var rc RequestContext
+		rc.ParseUsername(tt.raw)
+		if rc.UserID != tt.want.UserID || rc.Project != tt.want.Project || rc.Region != tt.want.Region ||
+			rc.Session != tt.want.Session || rc.Instance != tt.want.Instance || rc.Strategy != tt.want.Strategy ||
+			rc.SessionTTL != tt.want.SessionTTL {
+			t.Errorf("ParseUsername(%q) = %+v, want %+v", tt.raw, rc, tt.want)
+		}
+	}
+}
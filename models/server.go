@@ -3,6 +3,7 @@ package models
 import (
 	"bufio"
 	"bytes"
+	"container/list"
 	"context"
 	b64 "encoding/base64"
 	"fmt"
@@ -14,8 +15,11 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,16 +28,27 @@ const HTTP407 = "407 Proxy Authentication Required"
 
 type Proxy struct {
 	PrometheusAddress      string
+	AdminAddress           string
+	AdminToken             string
 	MetricsLogger          string
 	ExitNodesFile          string
 	AuthenticatedUsersFile string
 	ListenAddress          string
+	Socks5Address          string
 	Username               string
 	Password               string
 	Whitelist              string
-	Backends               []string
-	Sessions               map[string]ExitNode
-	ExitNodes              struct {
+
+	AllowDestinations        []string
+	DenyDestinations         []string
+	AllowPrivateDestinations bool
+	ConnectPorts             []string
+	Socks5Ports              []string
+	DenyList                 string
+	WhitelistFile            string
+	Backends                 []string
+	Sessions                 map[string]*Session
+	ExitNodes                struct {
 		All          []ExitNode
 		ByRegion     map[string][]ExitNode
 		ByInstanceID map[string]ExitNode
@@ -42,28 +57,92 @@ type Proxy struct {
 	Dialer       proxy.Dialer
 	Mutex        *sync.Mutex
 	Timeout      int
-	LogMetrics   bool
-	IsUpstream   bool
-	AuthUpstream bool
+	Retries      int
+	DrainTimeout time.Duration
+
+	MaxConnectionsPerUser int
+	RateLimitPerUser      float64
+	HostRateLimitPerUser  float64
+	LogMetrics            bool
+	IsUpstream            bool
+	AuthUpstream          bool
+
+	WatchExitNodes bool
+	WatchUsers     bool
+
+	HealthCheckInterval int
+	HealthCheckFailures int
+	HealthCheckTarget   string
+
+	Strategy string
+
+	SessionTTL   time.Duration
+	MaxSessions  int
+	SessionStore SessionStore
+	Quotas       *QuotaTracker
+
+	configuredExitNodes []ExitNode
+	sessionOrder        *list.List
+	available           map[string]bool
+	health              map[string]*exitNodeHealth
+	stats               map[string]*exitNodeStats
+	strategies          map[string]Strategy
+	drained             map[string]bool
+	tunnels             map[uint64]*Tunnel
+	tunnelMutex         sync.Mutex
+	userConnections     map[string]int64
+	connectionMutex     sync.Mutex
+	accessList          accessList
+	accessMutex         sync.RWMutex
+	destinations        destinationACL
+	server              *http.Server
+	acceptLoops         sync.WaitGroup
+	conns               map[net.Conn]http.ConnState
+	connMutex           sync.Mutex
+	activeCopies        int64
+	pendingTunnels      int64
+	pendingMetrics      int64
+	shuttingDown        int32
+	shutdownDone        chan struct{}
+	upgrading           int32
+	listeners           map[string]net.Listener
+	inherited           map[string]net.Listener
+	listenerMutex       sync.Mutex
+	readyFile           *os.File
+	stateFile           *os.File
+	stateWriter         *os.File
+	rateBuckets         map[string]*tokenBucket
+	rateBucketsPruned   time.Time
+	rateMutex           sync.Mutex
+	userThrottles       map[string]*throttle
+	exitNodeThrottles   map[string]*throttle
+	throttleMutex       sync.Mutex
 }
 
 func (p *Proxy) GetExitNode(requestContext RequestContext) (ExitNode, string) {
+	return p.getExitNode(requestContext, nil)
+}
+
+// an explicit instance or region never falls back to other nodes
+func (p *Proxy) getExitNode(requestContext RequestContext, excluded map[string]bool) (ExitNode, string) {
+	excluded = p.excludeForbidden(requestContext, excluded)
 	var exitNode ExitNode
 	if requestContext.Instance != "" {
-		exitNode, _ = p.ByInstanceID(requestContext.Instance)
-	} else if requestContext.Region != "" {
-		exitNode, _ = p.ByRegion(requestContext.Region)
+		exitNode, _ = p.ByInstanceID(requestContext.Instance, excluded)
 	} else if requestContext.Session != "" {
-		exitNode, _ = p.BySession(requestContext.UserID, requestContext.Session)
+		exitNode, _ = p.BySession(requestContext, excluded)
+	} else if requestContext.Region != "" {
+		exitNode, _ = p.ByRegion(requestContext.Region, requestContext.Strategy, excluded)
 	}
 
-	// get one at random (default) or if the others failed
-	if exitNode.Interface == "" && exitNode.Upstream == "" {
-		exitNode, _ = p.ByRandom()
+	// get one at random (default) or if the session failed
+	isPinned := requestContext.Instance != "" || requestContext.Region != ""
+	if exitNode.Interface == "" && exitNode.Upstream == "" && isPinned == false {
+		exitNode, _ = p.ByRandom(requestContext.Strategy, excluded)
 	}
 	backend := exitNode.Interface
 	if p.IsUpstream == true {
-		backend = exitNode.Upstream
+		backend = exitNode.Redacted().Upstream
 	}
 	log.Trace().
 		Str("exitNode", backend).
@@ -71,13 +150,60 @@ func (p *Proxy) GetExitNode(requestContext RequestContext) (ExitNode, string) {
 		Str("session", requestContext.Session).
 		Str("project", requestContext.Project).
 		Str("region", requestContext.Region).
+		Str("strategy", requestContext.Strategy).
 		Bool("upstream", p.IsUpstream).
 		Msg("ExitNode selected")
 	return exitNode, backend
 }
 
-func (p *Proxy) setDialer(requestContext RequestContext, isClearText bool) (ExitNode, string, proxy.Dialer) {
-	exitNode, backend := p.GetExitNode(requestContext)
+func (p *Proxy) instanceRejection(requestContext RequestContext) string {
+	user := requestContext.User
+	if requestContext.Instance == "" || user.restricted() == false || contains(user.Instances, requestContext.Instance) {
+		return ""
+	}
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	configured := false
+	for _, v := range p.configuredExitNodes {
+		if v.InstanceID != requestContext.Instance {
+			continue
+		}
+		if user.allowsExitNode(v) {
+			return ""
+		}
+		configured = true
+	}
+	// an unknown instance of a user limited to regions stays a 503
+	if configured == false && len(user.Regions) > 0 {
+		return ""
+	}
+	return causeInstanceNotAllowed
+}
+
+func (p *Proxy) excludeForbidden(requestContext RequestContext, excluded map[string]bool) map[string]bool {
+	user := requestContext.User
+	if user.restricted() == false {
+		return excluded
+	}
+	forbidden := map[string]bool{}
+	for k, v := range excluded {
+		forbidden[k] = v
+	}
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	for _, v := range p.configuredExitNodes {
+		if user.allowsExitNode(v) == false {
+			forbidden[v.Key()] = true
+		}
+	}
+	return forbidden
+}
+
+func (p *Proxy) exitNodeDialer(exitNode ExitNode, isClearText bool) (string, proxy.Dialer) {
+	backend := exitNode.Interface
+	if p.IsUpstream == true {
+		backend = exitNode.Upstream
+	}
 
 	network := "tcp4"
 	format := `%s:0`
@@ -110,23 +236,8 @@ func (p *Proxy) setDialer(requestContext RequestContext, isClearText bool) (Exit
 		Timeout:   time.Duration(p.Timeout) * time.Second,
 	}
 
-	return exitNode, network, thisDialer
+	return network, thisDialer
 }
-func (p *Proxy) isInWhitelist(requestAddress string) bool {
-	if p.Whitelist == "" {
-		return true
-	}
-	if addressParts := strings.Split(requestAddress, ":"); len(addressParts) > 0 {
-		parsedRequestAddress := addressParts[0]
-		for _, whitelistItem := range strings.Split(p.Whitelist, ",") {
-			if strings.HasPrefix(parsedRequestAddress, whitelistItem) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 func (p *Proxy) handleRequest(responseWriter http.ResponseWriter, request *http.Request) {
 	defer func() {
 		//Delete hop by hop headers
@@ -140,13 +251,14 @@ func (p *Proxy) handleRequest(responseWriter http.ResponseWriter, request *http.
 			request.Header.Del(v)
 		}
 	}()
-	if p.isInWhitelist(request.RemoteAddr) == false {
+	if cause := p.clientRejection(request.RemoteAddr); cause != "" {
+		writeProxyError(responseWriter, http.StatusForbidden, cause)
 		return
 	}
 	requestContext := RequestContext{}
 
 	passedAuthentication := false
-	if len(UserMap) == 0 {
+	if authenticationEnabled() == false {
 		passedAuthentication = true
 	}
 
@@ -156,6 +268,44 @@ func (p *Proxy) handleRequest(responseWriter http.ResponseWriter, request *http.
 			passedAuthentication = true
 		}
 	}
+	if passedAuthentication == false && requestContext.Busy == true {
+		p.LogRejection(requestContext, "auth_busy")
+		responseWriter.Header().Set("Retry-After", "1")
+		writeProxyError(responseWriter, http.StatusServiceUnavailable, causeAuthBusy)
+		return
+	}
+
+	if passedAuthentication == true && requestContext.Forbidden == "" {
+		requestContext.Forbidden = p.instanceRejection(requestContext)
+	}
+	if passedAuthentication == true && requestContext.Forbidden != "" {
+		log.Debug().Str("UserID", requestContext.UserID).Str("host", request.Host).Str("cause", requestContext.Forbidden).Msg("forbidden")
+		writeProxyError(responseWriter, http.StatusForbidden, requestContext.Forbidden)
+		return
+	}
+	if passedAuthentication == true {
+		destinationHost, destinationPort := requestDestination(request)
+		cause := p.destinationRejection(requestContext, destinationHost, destinationPort)
+		if cause == "" && request.Method == http.MethodConnect {
+			cause = p.connectPortRejection(requestContext, destinationPort)
+		}
+		if cause != "" {
+			log.Debug().Str("UserID", requestContext.UserID).Str("host", request.Host).Str("cause", cause).Msg("forbidden")
+			writeProxyError(responseWriter, http.StatusForbidden, cause)
+			return
+		}
+	}
+	if passedAuthentication == true && p.quotaExceeded(requestContext) {
+		writeProxyError(responseWriter, http.StatusPaymentRequired, causeQuotaExceeded)
+		return
+	}
+	if passedAuthentication == true {
+		if ok, wait := p.allowRequest(requestContext, request.Host); !ok {
+			responseWriter.Header().Set("Retry-After", strconv.Itoa(retryAfter(wait)))
+			writeProxyError(responseWriter, http.StatusTooManyRequests, causeRateLimited)
+			return
+		}
+	}
 
 	if passedAuthentication == true {
 		if request.Method == http.MethodConnect {
@@ -169,6 +319,12 @@ func (p *Proxy) handleRequest(responseWriter http.ResponseWriter, request *http.
 }
 
 func (p *Proxy) handleHTTP(responseWriter http.ResponseWriter, request *http.Request, requestContext RequestContext) {
+	if p.acquireUserConnection(requestContext) == false {
+		writeProxyError(responseWriter, http.StatusTooManyRequests, causeTooManyConnections)
+		return
+	}
+	defer p.releaseUserConnection(requestContext)
+
 	var buf bytes.Buffer
 	tee := io.TeeReader(request.Body, &buf)
 	bodySize, _ := io.ReadAll(tee)
@@ -180,23 +336,40 @@ func (p *Proxy) handleHTTP(responseWriter http.ResponseWriter, request *http.Req
 	}
 	requestSize := len(bodySize) + urlSize + headersSize
 
-	exitNode, _, thisDialer := p.setDialer(requestContext, true)
+	exitNode, _ := p.GetExitNode(requestContext)
+	if exitNode.Interface == "" && exitNode.Upstream == "" {
+		writeClassifiedError(responseWriter, ErrNoExitNodes)
+		return
+	}
+	_, thisDialer := p.exitNodeDialer(exitNode, true)
+	thisDialer = p.guardDialer(thisDialer, requestContext.User)
+	nodeStats := p.acquireExitNode(exitNode)
+	defer nodeStats.release()
 	transport := http.Transport{
 		DialContext: thisDialer.(interface {
 			DialContext(context context.Context, network, address string) (net.Conn, error)
 		}).DialContext,
 	}
 	if p.IsUpstream {
-		exitNodeUpstream := exitNode.Upstream
-		if strings.HasPrefix(exitNodeUpstream, "http") == false {
-			exitNodeUpstream = "http://" + exitNodeUpstream
-		}
-		u, err := url.Parse(exitNodeUpstream)
+		u, err := parseUpstream(exitNode.Upstream)
 		if err != nil {
 			log.Err(err).Str("upstream", exitNode.Upstream).Msg("error parsing upstream")
+			writeProxyError(responseWriter, http.StatusBadGateway, causeInvalidExitNodeUpstream)
 			return
 		}
-		if credentials := u.User.String(); credentials != "" {
+		if isSocksUpstream(u) {
+			socksDialer, err := p.socksUpstreamDialer(u, requestContext)
+			if err != nil {
+				log.Err(err).Str("upstream", exitNode.Upstream).Msg("error building socks upstream")
+				writeProxyError(responseWriter, http.StatusBadGateway, causeInvalidExitNodeUpstream)
+				return
+			}
+			transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, p.upstreamTimeout())
+				defer cancel()
+				return socksDialer.DialContext(ctx, network, address)
+			}
+		} else if credentials := u.User.String(); credentials != "" {
 			request.Header.Set("Proxy-Authorization", fmt.Sprintf("Basic %v", b64.StdEncoding.EncodeToString([]byte(credentials))))
 		} else {
 			for _, v := range []string{
@@ -209,36 +382,42 @@ func (p *Proxy) handleHTTP(responseWriter http.ResponseWriter, request *http.Req
 				request.Header.Del(v)
 			}
 		}
-		transport.Proxy = http.ProxyURL(u)
+		if isSocksUpstream(u) == false {
+			transport.Proxy = http.ProxyURL(u)
+		}
+		// the destination may be slow too so only with Timeout
+		if p.Timeout > 0 {
+			transport.ResponseHeaderTimeout = p.upstreamTimeout()
+		}
 	}
 
 	response, err := transport.RoundTrip(request)
 	if err != nil {
+		log.Trace().Err(err).Msg("HandleHTTP")
+		writeClassifiedError(responseWriter, err)
 		return
 	}
 	defer response.Body.Close()
 	copyHeader(responseWriter.Header(), response.Header)
 	responseWriter.WriteHeader(response.StatusCode)
-	bytesTransferred, _ := io.Copy(responseWriter, response.Body)
-	go func() {
-		p.LogPayload(MetricPayload{
-			Protocol:         "http",
-			UserID:           requestContext.UserID,
-			BytesTransferred: int64(requestSize),
-			Direction:        "tx",
-			Region:           requestContext.Region,
-			Host:             request.Host,
-		})
-
-		p.LogPayload(MetricPayload{
-			Protocol:         "http",
-			UserID:           requestContext.UserID,
-			BytesTransferred: bytesTransferred,
-			Direction:        "rx",
-			Region:           requestContext.Region,
-			Host:             request.Host,
-		})
-	}()
+	p.addQuotaUsage(requestContext, int64(requestSize))
+	bytesTransferred, _ := io.Copy(p.throttleWrap(p.quotaWrap(responseWriter, requestContext), requestContext, exitNode), response.Body)
+	nodeStats.addBytes(int64(requestSize) + bytesTransferred)
+	p.logPayloadAsync(MetricPayload{
+		Protocol:         "http",
+		UserID:           requestContext.UserID,
+		BytesTransferred: int64(requestSize),
+		Direction:        "tx",
+		Region:           requestContext.Region,
+		Host:             request.Host,
+	}, MetricPayload{
+		Protocol:         "http",
+		UserID:           requestContext.UserID,
+		BytesTransferred: bytesTransferred,
+		Direction:        "rx",
+		Region:           requestContext.Region,
+		Host:             request.Host,
+	})
 }
 
 func (p *Proxy) getUpstream(upstream string, addr string, requestContext RequestContext) (net.Conn, error) {
@@ -262,11 +441,15 @@ func (p *Proxy) getUpstream(upstream string, addr string, requestContext Request
 		Header: hdr,
 	}
 
-	c, err := net.DialTimeout(network, upstream, time.Duration(10)*time.Second)
+	c, err := net.DialTimeout(network, upstream, upstreamDialTimeout)
 	if err != nil {
+		return nil, exitNodeError{err: err}
+	}
+	_ = c.SetDeadline(time.Now().Add(p.upstreamTimeout()))
+	if err = connectReq.Write(c); err != nil {
+		_ = c.Close()
 		return nil, err
 	}
-	_ = connectReq.Write(c)
 	br := bufio.NewReader(c)
 	resp, err := http.ReadResponse(br, connectReq)
 	if err != nil {
@@ -274,26 +457,87 @@ func (p *Proxy) getUpstream(upstream string, addr string, requestContext Request
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = c.Close()
+		return nil, errors.Wrap(ErrUpstreamRefused, resp.Status)
+	}
+	_ = c.SetDeadline(time.Time{})
 
 	return c, nil
 }
 
-func (p *Proxy) handleTunnel(responseWriter http.ResponseWriter, request *http.Request, requestContext RequestContext) {
-	var destinationConnection net.Conn
-	var err error
-	exitNode, network, thisDialer := p.setDialer(requestContext, false)
+func (p *Proxy) dialTunnel(requestContext RequestContext, host string) (net.Conn, ExitNode, error) {
+	excluded := map[string]bool{}
+	err := ErrNoExitNodes
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		exitNode, backend := p.getExitNode(requestContext, excluded)
+		if exitNode.Interface == "" && exitNode.Upstream == "" {
+			break
+		}
+		var destinationConnection net.Conn
+		destinationConnection, err = p.dialExitNode(exitNode, requestContext, host)
+		if err == nil {
+			return destinationConnection, exitNode, nil
+		}
+		log.Trace().Err(err).Str("exitNode", backend).Int("attempt", attempt).Str("host", host).Msg("dialTunnel")
+		if errors.Is(err, ErrDestinationNotAllowed) {
+			break
+		}
+		excluded[exitNode.Key()] = true
+	}
+	return nil, ExitNode{}, err
+}
+
+func (p *Proxy) dialExitNode(exitNode ExitNode, requestContext RequestContext, host string) (net.Conn, error) {
+	return p.dialExitNodeGuarded(exitNode, requestContext, host, true)
+}
+
+// unguarded for operator traffic such as probes
+func (p *Proxy) dialExitNodeGuarded(exitNode ExitNode, requestContext RequestContext, host string, guarded bool) (net.Conn, error) {
+	network, thisDialer := p.exitNodeDialer(exitNode, false)
+	if guarded == true {
+		thisDialer = p.guardDialer(thisDialer, requestContext.User)
+	}
 
 	if p.IsUpstream == true {
-		destinationConnection, err = p.getUpstream(exitNode.Upstream, request.Host, requestContext)
-	} else {
-		destinationConnection, err = thisDialer.Dial(network, request.Host)
+		upstreamURL, err := parseUpstream(exitNode.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		if isSocksUpstream(upstreamURL) {
+			socksDialer, err := p.socksUpstreamDialer(upstreamURL, requestContext)
+			if err != nil {
+				return nil, err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), p.upstreamTimeout())
+			defer cancel()
+			return socksDialer.DialContext(ctx, "tcp", host)
+		}
+		return p.getUpstream(exitNode.Upstream, host, requestContext)
+	}
+	return thisDialer.Dial(network, host)
+}
+
+func (p *Proxy) handleTunnel(responseWriter http.ResponseWriter, request *http.Request, requestContext RequestContext) {
+	// hijacked connections leave http.Server's tracking before openTunnel counts their copies
+	atomic.AddInt64(&p.pendingTunnels, 1)
+	defer atomic.AddInt64(&p.pendingTunnels, -1)
+	if p.acquireUserConnection(requestContext) == false {
+		writeProxyError(responseWriter, http.StatusTooManyRequests, causeTooManyConnections)
+		return
 	}
+	destinationConnection, exitNode, err := p.dialTunnel(requestContext, request.Host)
 	if err != nil {
 		log.Trace().Err(err).Msg("HandleTunnel")
+		p.releaseUserConnection(requestContext)
+		writeClassifiedError(responseWriter, err)
+		return
 	}
 
 	hijacker, ok := responseWriter.(http.Hijacker)
 	if !ok {
+		p.releaseUserConnection(requestContext)
+		_ = destinationConnection.Close()
 		return
 	}
 
@@ -302,12 +546,15 @@ func (p *Proxy) handleTunnel(responseWriter http.ResponseWriter, request *http.R
 		if sourceConnection != nil {
 			_ = sourceConnection.Close()
 		}
+		p.releaseUserConnection(requestContext)
+		_ = destinationConnection.Close()
 		return
 	}
 	_, _ = sourceConnection.Write([]byte(HTTP200))
 
-	go p.copyIO(sourceConnection, destinationConnection, "rx", requestContext, request.Host)
-	go p.copyIO(destinationConnection, sourceConnection, "tx", requestContext, request.Host)
+	tunnel := p.openTunnel("https", request.Host, requestContext, exitNode, sourceConnection, destinationConnection)
+	go p.copyIO(sourceConnection, destinationConnection, "rx", tunnel)
+	go p.copyIO(destinationConnection, sourceConnection, "tx", tunnel)
 }
 
 func (p *Proxy) handleProxyAuthRequired(responseWriter http.ResponseWriter, request *http.Request) {
@@ -338,23 +585,105 @@ func (p *Proxy) handleProxyAuthRequired(responseWriter http.ResponseWriter, requ
 }
 
 func (p *Proxy) Run() {
+	if err := p.inheritListeners(); err != nil {
+		log.Fatal().Err(err).Str("method", "inheritListeners").Msg("sockets")
+	}
 	if p.MetricsLogger == "prometheus" {
+		listener, err := p.listen("prometheus", p.PrometheusAddress)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Prometheus handler")
+		}
 		go func() {
 			http.Handle("/metrics", promhttp.Handler())
-			if err := http.ListenAndServe(p.PrometheusAddress, nil); err != nil {
+			if err := http.Serve(listener, nil); err != nil && p.ShuttingDown() == false {
 				log.Fatal().Err(err).Msg("Prometheus handler")
 			}
 		}()
 	}
 
-	p.ExitNodesFromDisk()
-	err := http.ListenAndServe(p.ListenAddress, http.HandlerFunc(p.handleRequest))
+	if err := p.ExitNodesFromDisk(); err != nil {
+		log.Fatal().Err(err).Str("method", "ExitNodesFromDisk").Msg("exitNodes")
+	}
+	if p.WatchExitNodes == true {
+		if err := WatchFile(p.ExitNodesFile, p.ReloadExitNodes); err != nil {
+			log.Warn().Err(err).Str("filename", p.ExitNodesFile).Msg("can't watch exitNodes file")
+		}
+	}
+	if err := p.loadDestinationACL(); err != nil {
+		log.Fatal().Err(err).Str("method", "loadDestinationACL").Msg("destinations")
+	}
+	if err := validatePorts(p.ConnectPorts); err != nil {
+		log.Fatal().Err(err).Str("method", "validatePorts").Msg("connect ports")
+	}
+	if err := validatePorts(p.Socks5Ports); err != nil {
+		log.Fatal().Err(err).Str("method", "validatePorts").Msg("socks5 ports")
+	}
+	if err := p.loadAccessList(); err != nil {
+		log.Fatal().Err(err).Str("method", "loadAccessList").Msg("whitelist")
+	}
+	if p.WhitelistFile != "" {
+		if err := WatchFile(p.WhitelistFile, p.ReloadAccessList); err != nil {
+			log.Warn().Err(err).Str("filename", p.WhitelistFile).Msg("can't watch whitelist file")
+		}
+	}
+	if p.WatchUsers == true && p.AuthenticatedUsersFile != "" {
+		if err := WatchFile(p.AuthenticatedUsersFile, func() { _ = p.ReloadUsers() }); err != nil {
+			log.Warn().Err(err).Str("filename", p.AuthenticatedUsersFile).Msg("can't watch users file")
+		}
+	}
+	if p.Quotas == nil {
+		p.Quotas, _ = NewQuotaTracker("")
+	}
+	p.receiveState()
+	p.server = &http.Server{Handler: http.HandlerFunc(p.handleRequest), ConnState: p.trackConn}
+	p.shutdownDone = make(chan struct{})
+	go p.handleSignals()
+	if p.AdminAddress != "" {
+		listener, err := p.listen("admin", p.AdminAddress)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Admin handler")
+		}
+		go func() {
+			if err := http.Serve(listener, p.AdminHandler()); err != nil && p.ShuttingDown() == false {
+				log.Fatal().Err(err).Msg("Admin handler")
+			}
+		}()
+	}
+	go p.RunSessionJanitor()
+	if p.HealthCheckInterval > 0 {
+		go p.RunHealthChecks()
+	}
+	if p.Socks5Address != "" {
+		listener, err := p.listen("socks5", p.Socks5Address)
+		if err != nil {
+			log.Fatal().Err(err).Msg("ListenSocks5")
+		}
+		p.acceptLoops.Add(1)
+		go func() {
+			defer p.acceptLoops.Done()
+			if err := p.serveSocks5(listener); err != nil {
+				log.Fatal().Err(err).Msg("ListenSocks5")
+			}
+		}()
+	}
+	listener, err := p.listen("proxy", p.ListenAddress)
 	if err != nil {
 		log.Fatal().Err(err).Msg("ListenAndServe")
 	}
+	p.closeUnusedListeners()
+	p.notifyReady()
+	p.acceptLoops.Add(1)
+	err = p.server.Serve(listener)
+	p.acceptLoops.Done()
+	if p.ShuttingDown() == true {
+		<-p.shutdownDone
+		return
+	}
+	log.Fatal().Err(err).Msg("ListenAndServe")
 }
 
-func (p *Proxy) copyIO(src, dest net.Conn, direction string, requestContext RequestContext, host string) (err error) {
+func (p *Proxy) copyIO(src, dest net.Conn, direction string, tunnel *Tunnel) (err error) {
+	defer atomic.AddInt64(&p.activeCopies, -1)
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
@@ -389,19 +718,21 @@ func (p *Proxy) copyIO(src, dest net.Conn, direction string, requestContext Requ
 		return
 	}
 
-	bx, err := io.Copy(src, dest)
+	bx, err := io.Copy(p.throttleWrap(p.quotaWrap(src, tunnel.RequestContext), tunnel.RequestContext, tunnel.ExitNode), dest)
 	if err != nil {
 		//log.Trace().Err(err).Msg("copy")
 	}
-	go func() {
-		p.LogPayload(MetricPayload{
-			Protocol:         "https",
-			UserID:           requestContext.UserID,
-			BytesTransferred: bx,
-			Direction:        direction,
-			Region:           requestContext.Region,
-			Host:             host,
-		})
-	}()
+	tunnel.nodeStats.addBytes(bx)
+	if direction == "rx" {
+		p.closeTunnel(tunnel)
+	}
+	p.logPayloadAsync(MetricPayload{
+		Protocol:         tunnel.Protocol,
+		UserID:           tunnel.RequestContext.UserID,
+		BytesTransferred: bx,
+		Direction:        direction,
+		Region:           tunnel.RequestContext.Region,
+		Host:             tunnel.Host,
+	})
 	return
 }
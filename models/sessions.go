@@ -0,0 +1,114 @@
+package models
+
+import (
+	"container/list"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const sessionJanitorInterval = time.Minute
+
+// a zero TTL never expires
+type Session struct {
+	ExitNode  ExitNode
+	CreatedAt time.Time
+	LastUsed  time.Time
+	TTL       time.Duration
+
+	element     *list.Element
+	persistedAt time.Time
+}
+
+func (s *Session) Expired(now time.Time) bool {
+	return s.TTL > 0 && now.Sub(s.LastUsed) > s.TTL
+}
+
+func (p *Proxy) sessionTTL(requestContext RequestContext) time.Duration {
+	if requestContext.SessionTTL > 0 {
+		return requestContext.SessionTTL
+	}
+	return p.SessionTTL
+}
+
+// caller must hold SessionMutex
+func (p *Proxy) touchSession(sessionKey string, ttl time.Duration) (*Session, bool) {
+	session, ok := p.Sessions[sessionKey]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if session.Expired(now) {
+		p.deleteSession(sessionKey)
+		return nil, false
+	}
+	session.LastUsed = now
+	session.TTL = ttl
+	if session.element != nil {
+		p.sessionOrder.MoveToFront(session.element)
+	}
+	return session, true
+}
+
+// caller must hold SessionMutex
+func (p *Proxy) storeSession(sessionKey string, exitNode ExitNode, ttl time.Duration) *Session {
+	if p.sessionOrder == nil {
+		p.sessionOrder = list.New()
+	}
+	if _, ok := p.Sessions[sessionKey]; ok {
+		p.deleteSession(sessionKey)
+	}
+
+	now := time.Now()
+	session := &Session{
+		ExitNode:  exitNode,
+		CreatedAt: now,
+		LastUsed:  now,
+		TTL:       ttl,
+	}
+	session.element = p.sessionOrder.PushFront(sessionKey)
+	p.Sessions[sessionKey] = session
+
+	for p.MaxSessions > 0 && len(p.Sessions) > p.MaxSessions {
+		oldest := p.sessionOrder.Back()
+		if oldest == nil {
+			break
+		}
+		p.deleteSession(oldest.Value.(string))
+	}
+	return session
+}
+
+// caller must hold SessionMutex
+func (p *Proxy) deleteSession(sessionKey string) {
+	session, ok := p.Sessions[sessionKey]
+	if !ok {
+		return
+	}
+	if session.element != nil && p.sessionOrder != nil {
+		p.sessionOrder.Remove(session.element)
+	}
+	delete(p.Sessions, sessionKey)
+}
+
+func (p *Proxy) RunSessionJanitor() {
+	ticker := time.NewTicker(sessionJanitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.expireSessions(time.Now())
+	}
+}
+
+func (p *Proxy) expireSessions(now time.Time) {
+	p.SessionMutex.Lock()
+	defer p.SessionMutex.Unlock()
+	expired := 0
+	for sessionKey, session := range p.Sessions {
+		if session.Expired(now) {
+			p.deleteSession(sessionKey)
+			expired++
+		}
+	}
+	if expired > 0 {
+		log.Debug().Int("expired", expired).Int("sessions", len(p.Sessions)).Msg("sessions expired")
+	}
+}
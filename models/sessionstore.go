@@ -0,0 +1,308 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	sessionStoreTimeout       = 2 * time.Second
+	sessionStoreFlushInterval = 30 * time.Second
+	redisSessionPrefix        = "moxxi:session:"
+)
+
+type StoredSession struct {
+	ExitNodeID string        `json:"exit_node_id"`
+	CreatedAt  time.Time     `json:"created_at"`
+	LastUsed   time.Time     `json:"last_used"`
+	TTL        time.Duration `json:"ttl"`
+}
+
+// upstream credentials stay out of the store
+func storedExitNodeID(exitNode ExitNode) string {
+	sum := sha256.Sum256([]byte(exitNode.Key()))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (p *Proxy) storedExitNode(stored StoredSession) (ExitNode, bool) {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	for _, v := range p.configuredExitNodes {
+		if storedExitNodeID(v) == stored.ExitNodeID {
+			return v, true
+		}
+	}
+	return ExitNode{}, false
+}
+
+func (s StoredSession) Expired(now time.Time) bool {
+	return s.TTL > 0 && now.Sub(s.LastUsed) > s.TTL
+}
+
+type SessionStore interface {
+	Get(sessionKey string) (StoredSession, bool, error)
+	Set(sessionKey string, session StoredSession) error
+	Delete(sessionKey string) error
+	Close() error
+}
+
+func NewSessionStore(rawURL string) (SessionStore, error) {
+	storeURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch storeURL.Scheme {
+	case "file":
+		return NewFileSessionStore(urlFilename(storeURL))
+	case "redis", "rediss":
+		options, err := redis.ParseURL(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisSessionStore{client: redis.NewClient(options)}, nil
+	}
+	return nil, fmt.Errorf("unsupported session store %q", storeURL.Scheme)
+}
+
+type FileSessionStore struct {
+	filename   string
+	mutex      sync.Mutex
+	sessions   map[string]StoredSession
+	dirty      bool
+	done       chan struct{}
+	handingOff bool
+}
+
+func NewFileSessionStore(filename string) (*FileSessionStore, error) {
+	store := &FileSessionStore{
+		filename: filename,
+		sessions: map[string]StoredSession{},
+		done:     make(chan struct{}),
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil && os.IsNotExist(err) == false {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &store.sessions); err != nil {
+			return nil, fmt.Errorf("can't parse sessions file: %w", err)
+		}
+	}
+	go store.flushLoop()
+	return store, nil
+}
+
+func (s *FileSessionStore) Get(sessionKey string) (StoredSession, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[sessionKey]
+	if ok && session.Expired(time.Now()) {
+		delete(s.sessions, sessionKey)
+		s.dirty = true
+		return StoredSession{}, false, nil
+	}
+	return session, ok, nil
+}
+
+func (s *FileSessionStore) Set(sessionKey string, session StoredSession) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[sessionKey] = session
+	s.dirty = true
+	return nil
+}
+
+func (s *FileSessionStore) Delete(sessionKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, sessionKey)
+	s.dirty = true
+	return nil
+}
+
+func (s *FileSessionStore) Close() error {
+	close(s.done)
+	return s.Flush()
+}
+
+func (s *FileSessionStore) Flush() error {
+	s.mutex.Lock()
+	if s.dirty == false || s.handingOff == true {
+		s.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	for sessionKey, session := range s.sessions {
+		if session.Expired(now) {
+			delete(s.sessions, sessionKey)
+		}
+	}
+	data, err := json.Marshal(s.sessions)
+	s.dirty = false
+	s.mutex.Unlock()
+	if err == nil {
+		err = writeFileAtomic(s.filename, data)
+	}
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+func (s *FileSessionStore) handOff() map[string]StoredSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handingOff = true
+	snapshot := make(map[string]StoredSession, len(s.sessions))
+	for sessionKey, session := range s.sessions {
+		snapshot[sessionKey] = session
+	}
+	return snapshot
+}
+
+func (s *FileSessionStore) cancelHandOff() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handingOff = false
+}
+
+// the most recently used copy of a session wins
+func (s *FileSessionStore) restore(sessions map[string]StoredSession, replace bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if replace == true {
+		s.sessions = map[string]StoredSession{}
+		s.dirty = true
+	}
+	for sessionKey, session := range sessions {
+		if current, ok := s.sessions[sessionKey]; ok == false || session.LastUsed.After(current.LastUsed) {
+			s.sessions[sessionKey] = session
+			s.dirty = true
+		}
+	}
+}
+
+func (s *FileSessionStore) flushLoop() {
+	ticker := time.NewTicker(sessionStoreFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Warn().Err(err).Str("filename", s.filename).Msg("FileSessionStore.Flush")
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+func (s *RedisSessionStore) Get(sessionKey string) (StoredSession, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, redisSessionPrefix+sessionKey).Bytes()
+	if err == redis.Nil {
+		return StoredSession{}, false, nil
+	}
+	if err != nil {
+		return StoredSession{}, false, err
+	}
+	var session StoredSession
+	if err = json.Unmarshal(data, &session); err != nil {
+		return StoredSession{}, false, err
+	}
+	return session, true, nil
+}
+
+func (s *RedisSessionStore) Set(sessionKey string, session StoredSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	return s.client.Set(ctx, redisSessionPrefix+sessionKey, data, session.TTL).Err()
+}
+
+func (s *RedisSessionStore) Delete(sessionKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStoreTimeout)
+	defer cancel()
+	return s.client.Del(ctx, redisSessionPrefix+sessionKey).Err()
+}
+
+func (s *RedisSessionStore) Close() error {
+	return s.client.Close()
+}
+
+func (p *Proxy) loadStoredSession(sessionKey string) (StoredSession, bool) {
+	if p.SessionStore == nil {
+		return StoredSession{}, false
+	}
+	stored, ok, err := p.SessionStore.Get(sessionKey)
+	if err != nil {
+		log.Warn().Err(err).Str("session", sessionKey).Msg("SessionStore.Get")
+		return StoredSession{}, false
+	}
+	if ok == false || stored.Expired(time.Now()) {
+		return StoredSession{}, false
+	}
+	return stored, true
+}
+
+func (p *Proxy) loadStoredExitNode(sessionKey string) (StoredSession, ExitNode, bool) {
+	stored, ok := p.loadStoredSession(sessionKey)
+	if ok == false {
+		return StoredSession{}, ExitNode{}, false
+	}
+	exitNode, ok := p.storedExitNode(stored)
+	if ok == false {
+		if err := p.SessionStore.Delete(sessionKey); err != nil {
+			log.Warn().Err(err).Str("session", sessionKey).Msg("SessionStore.Delete")
+		}
+		return StoredSession{}, ExitNode{}, false
+	}
+	return stored, exitNode, true
+}
+
+// hits only rewrite it once a quarter of the TTL passed
+func (p *Proxy) refreshStoredSession(sessionKey string, session *Session) {
+	if p.SessionStore == nil {
+		return
+	}
+	p.SessionMutex.Lock()
+	refreshEvery := session.TTL / 4
+	if refreshEvery == 0 {
+		refreshEvery = sessionJanitorInterval
+	}
+	if session.persistedAt.IsZero() == false && time.Since(session.persistedAt) < refreshEvery {
+		p.SessionMutex.Unlock()
+		return
+	}
+	session.persistedAt = time.Now()
+	stored := StoredSession{
+		ExitNodeID: storedExitNodeID(session.ExitNode),
+		CreatedAt:  session.CreatedAt,
+		LastUsed:   session.LastUsed,
+		TTL:        session.TTL,
+	}
+	p.SessionMutex.Unlock()
+
+	if err := p.SessionStore.Set(sessionKey, stored); err != nil {
+		log.Warn().Err(err).Str("session", sessionKey).Msg("SessionStore.Set")
+	}
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+func (p *Proxy) logPayloadAsync(payloads ...MetricPayload) {
+	atomic.AddInt64(&p.pendingMetrics, 1)
+	go func() {
+		defer atomic.AddInt64(&p.pendingMetrics, -1)
+		for _, payload := range payloads {
+			p.LogPayload(payload)
+		}
+	}()
+}
+
+func waitFor(ctx context.Context, done func() bool) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for done() == false {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// hijacked connections are left to the tunnel counters
+func (p *Proxy) trackConn(conn net.Conn, state http.ConnState) {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	if p.conns == nil {
+		p.conns = map[net.Conn]http.ConnState{}
+	}
+	if state == http.StateHijacked || state == http.StateClosed {
+		delete(p.conns, conn)
+		return
+	}
+	p.conns[conn] = state
+}
+
+func (p *Proxy) closeIdleConns() bool {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	for conn, state := range p.conns {
+		if state == http.StateIdle {
+			_ = conn.Close()
+			delete(p.conns, conn)
+		}
+	}
+	return len(p.conns) == 0
+}
+
+func (p *Proxy) openConns() int {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	return len(p.conns)
+}
+
+func (p *Proxy) ShuttingDown() bool {
+	return atomic.LoadInt32(&p.shuttingDown) == 1
+}
+
+func (p *Proxy) Shutdown() {
+	if atomic.CompareAndSwapInt32(&p.shuttingDown, 0, 1) == false {
+		return
+	}
+	defer close(p.shutdownDone)
+	log.Info().Dur("drainTimeout", p.DrainTimeout).Int("tunnels", len(p.Tunnels())).Msg("draining")
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.DrainTimeout)
+	defer cancel()
+	// accept loops have to return before the drain starts so every connection is counted
+	p.closeListeners("proxy", "socks5", "admin", "prometheus")
+	p.acceptLoops.Wait()
+
+	// http.Server.Shutdown drops requests read after it started, so keep-alives are turned off instead
+	p.server.SetKeepAlivesEnabled(false)
+	drained := waitFor(ctx, func() bool {
+		return p.closeIdleConns() == true && atomic.LoadInt64(&p.pendingTunnels) == 0 &&
+			atomic.LoadInt64(&p.activeCopies) == 0
+	})
+	if drained == false {
+		tunnels := p.Tunnels()
+		log.Warn().Int("requests", p.openConns()).Int("tunnels", len(tunnels)).Msg("drain timeout, closing connections")
+		_ = p.server.Close()
+		for _, tunnel := range tunnels {
+			_ = tunnel.source.Close()
+			_ = tunnel.destination.Close()
+		}
+	}
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	waitFor(flushCtx, func() bool {
+		return atomic.LoadInt64(&p.activeCopies) == 0 && atomic.LoadInt64(&p.pendingMetrics) == 0
+	})
+
+	// after an upgrade the files belong to the new process
+	if p.stateWriter != nil {
+		p.sendDrainedState()
+	}
+	if p.Quotas != nil {
+		if err := p.Quotas.Close(); err != nil {
+			log.Warn().Err(err).Msg("QuotaTracker.Close")
+		}
+	}
+	if p.SessionStore != nil {
+		if err := p.SessionStore.Close(); err != nil {
+			log.Warn().Err(err).Msg("SessionStore.Close")
+		}
+	}
+	log.Info().Msg("shutdown complete")
+}
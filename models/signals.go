@@ -0,0 +1,40 @@
+package models
+
+import (
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// a second SIGTERM or SIGINT exits right away
+func (p *Proxy) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		if sig == syscall.SIGUSR2 {
+			go func() {
+				if err := p.Upgrade(); err != nil {
+					log.Error().Err(err).Msg("upgrade failed, still serving")
+				}
+			}()
+			continue
+		}
+		if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+			if p.ShuttingDown() == true {
+				log.Warn().Str("signal", sig.String()).Msg("exiting without draining")
+				os.Exit(1)
+			}
+			go p.Shutdown()
+			continue
+		}
+		log.Info().Str("signal", sig.String()).Msg("reloading")
+		p.ReloadExitNodes()
+		if p.WhitelistFile != "" {
+			p.ReloadAccessList()
+		}
+		if p.AuthenticatedUsersFile != "" {
+			_ = p.ReloadUsers()
+		}
+	}
+}
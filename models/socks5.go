@@ -0,0 +1,281 @@
+package models
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	socks5Version          = 0x05
+	socks5PasswordVersion  = 0x01
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5CmdConnect       = 0x01
+	socks5AtypIPv4         = 0x01
+	socks5AtypDomain       = 0x03
+	socks5AtypIPv6         = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyTTLExpired          = 0x06
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddressNotSupported = 0x08
+
+	socks5HandshakeTimeout = 30 * time.Second
+)
+
+var errSocks5AddressType = errors.New("unsupported address type")
+
+func (p *Proxy) serveSocks5(listener net.Listener) error {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			if p.ShuttingDown() == true {
+				return nil
+			}
+			return err
+		}
+		atomic.AddInt64(&p.pendingTunnels, 1)
+		go func() {
+			defer atomic.AddInt64(&p.pendingTunnels, -1)
+			p.handleSocks5(conn)
+		}()
+	}
+}
+
+func (p *Proxy) handleSocks5(sourceConnection net.Conn) {
+	if p.clientRejection(sourceConnection.RemoteAddr().String()) != "" {
+		_ = sourceConnection.Close()
+		return
+	}
+	_ = sourceConnection.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	requestContext, err := p.socks5Authenticate(sourceConnection)
+	if err != nil {
+		log.Trace().Err(err).Str("method", "handleSocks5").Msg("authentication")
+		_ = sourceConnection.Close()
+		return
+	}
+
+	host, err := p.socks5ReadRequest(sourceConnection)
+	if err != nil {
+		log.Trace().Err(err).Str("method", "handleSocks5").Msg("request")
+		_ = sourceConnection.Close()
+		return
+	}
+
+	destinationHost, destinationPort := splitDestination(host, 0)
+	cause := p.instanceRejection(requestContext)
+	if cause == "" {
+		cause = p.destinationRejection(requestContext, destinationHost, destinationPort)
+	}
+	if cause == "" {
+		cause = p.socks5PortRejection(requestContext, destinationPort)
+	}
+	if cause != "" {
+		log.Debug().Str("UserID", requestContext.UserID).Str("host", host).Str("cause", cause).Msg("forbidden")
+		requestContext.Forbidden = cause
+	}
+	if requestContext.Forbidden != "" || p.quotaExceeded(requestContext) {
+		_ = socks5WriteReply(sourceConnection, socks5ReplyNotAllowed)
+		_ = sourceConnection.Close()
+		return
+	}
+
+	if ok, _ := p.allowRequest(requestContext, host); !ok {
+		_ = socks5WriteReply(sourceConnection, socks5ReplyNotAllowed)
+		_ = sourceConnection.Close()
+		return
+	}
+
+	if p.acquireUserConnection(requestContext) == false {
+		_ = socks5WriteReply(sourceConnection, socks5ReplyNotAllowed)
+		_ = sourceConnection.Close()
+		return
+	}
+	destinationConnection, exitNode, err := p.dialTunnel(requestContext, host)
+	if err != nil {
+		log.Trace().Err(err).Str("method", "handleSocks5").Msg("dial")
+		p.releaseUserConnection(requestContext)
+		_ = socks5WriteReply(sourceConnection, socks5ErrorReply(err))
+		_ = sourceConnection.Close()
+		return
+	}
+
+	if err = socks5WriteReply(sourceConnection, socks5ReplySucceeded); err != nil {
+		p.releaseUserConnection(requestContext)
+		_ = sourceConnection.Close()
+		_ = destinationConnection.Close()
+		return
+	}
+	_ = sourceConnection.SetDeadline(time.Time{})
+
+	tunnel := p.openTunnel("socks5", host, requestContext, exitNode, sourceConnection, destinationConnection)
+	go p.copyIO(sourceConnection, destinationConnection, "rx", tunnel)
+	go p.copyIO(destinationConnection, sourceConnection, "tx", tunnel)
+}
+
+func (p *Proxy) socks5Authenticate(conn net.Conn) (RequestContext, error) {
+	requestContext := RequestContext{}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return requestContext, err
+	}
+	if header[0] != socks5Version {
+		return requestContext, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return requestContext, err
+	}
+
+	acceptsNone := false
+	acceptsPassword := false
+	for _, method := range methods {
+		if method == socks5AuthNone {
+			acceptsNone = true
+		}
+		if method == socks5AuthPassword {
+			acceptsPassword = true
+		}
+	}
+
+	// password auth is preferred even without users so routing tokens still apply
+	if acceptsPassword == false {
+		if acceptsNone == true && authenticationEnabled() == false {
+			requestContext.Authenticated = true
+			_, err := conn.Write([]byte{socks5Version, socks5AuthNone})
+			return requestContext, err
+		}
+		if acceptsNone == true && requestContext.FromAddress(conn.RemoteAddr().String()) {
+			_, err := conn.Write([]byte{socks5Version, socks5AuthNone})
+			return requestContext, err
+		}
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return requestContext, errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthPassword}); err != nil {
+		return requestContext, err
+	}
+
+	username, password, err := socks5ReadCredentials(conn)
+	if err != nil {
+		return requestContext, err
+	}
+	requestContext.FromCredentials(username, password)
+	if requestContext.Authenticated == false {
+		requestContext.FromAddress(conn.RemoteAddr().String())
+	}
+	if requestContext.Authenticated == false {
+		_, _ = conn.Write([]byte{socks5PasswordVersion, 0x01})
+		if requestContext.Busy == true {
+			p.LogRejection(requestContext, "auth_busy")
+			return requestContext, ErrPasswordCheckBusy
+		}
+		return requestContext, errors.New("invalid credentials")
+	}
+	_, err = conn.Write([]byte{socks5PasswordVersion, 0x00})
+	return requestContext, err
+}
+
+func socks5ReadCredentials(conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socks5PasswordVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", "", err
+	}
+	passwordLength := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passwordLength); err != nil {
+		return "", "", err
+	}
+	password := make([]byte, passwordLength[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", "", err
+	}
+	return string(username), string(password), nil
+}
+
+func (p *Proxy) socks5ReadRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	if header[1] != socks5CmdConnect {
+		_ = socks5WriteReply(conn, socks5ReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if header[3] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = socks5WriteReply(conn, socks5ReplyAddressNotSupported)
+		return "", errSocks5AddressType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socks5ErrorReply(err error) byte {
+	switch _, cause := classifyError(err); cause {
+	case causeTimeout:
+		return socks5ReplyTTLExpired
+	case causeDestinationUnreachable:
+		return socks5ReplyHostUnreachable
+	}
+	return socks5ReplyGeneralFailure
+}
+
+// clients don't rely on the bind address for CONNECT
+func socks5WriteReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
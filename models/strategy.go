@@ -0,0 +1,172 @@
+package models
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "roundrobin"
+	StrategyWeighted   = "weighted"
+	StrategyLeastConn  = "leastconn"
+	StrategyLeastBytes = "leastbytes"
+)
+
+var StrategyNames = []string{
+	StrategyRandom,
+	StrategyRoundRobin,
+	StrategyWeighted,
+	StrategyLeastConn,
+	StrategyLeastBytes,
+}
+
+type Strategy interface {
+	Pick(pool string, candidates []ExitNode, stats map[string]*exitNodeStats) ExitNode
+}
+
+// fields are updated atomically
+type exitNodeStats struct {
+	Active int64
+	Bytes  int64
+}
+
+func ValidStrategy(name string) bool {
+	for _, v := range StrategyNames {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newStrategies() map[string]Strategy {
+	return map[string]Strategy{
+		StrategyRandom:     randomStrategy{},
+		StrategyRoundRobin: &roundRobinStrategy{counters: map[string]*uint64{}},
+		StrategyWeighted:   weightedStrategy{},
+		StrategyLeastConn:  leastStrategy{metric: func(s *exitNodeStats) int64 { return atomic.LoadInt64(&s.Active) }},
+		StrategyLeastBytes: leastStrategy{metric: func(s *exitNodeStats) int64 { return atomic.LoadInt64(&s.Bytes) }},
+	}
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Pick(_ string, candidates []ExitNode, _ map[string]*exitNodeStats) ExitNode {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// only called under Proxy.Mutex
+type roundRobinStrategy struct {
+	counters map[string]*uint64
+}
+
+func (s *roundRobinStrategy) Pick(pool string, candidates []ExitNode, _ map[string]*exitNodeStats) ExitNode {
+	counter, ok := s.counters[pool]
+	if !ok {
+		counter = new(uint64)
+		s.counters[pool] = counter
+	}
+	next := *counter
+	*counter++
+	return candidates[next%uint64(len(candidates))]
+}
+
+type weightedStrategy struct{}
+
+func (weightedStrategy) Pick(_ string, candidates []ExitNode, _ map[string]*exitNodeStats) ExitNode {
+	total := 0
+	for _, v := range candidates {
+		total += v.weight()
+	}
+	target := rand.Intn(total)
+	for _, v := range candidates {
+		target -= v.weight()
+		if target < 0 {
+			return v
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+type leastStrategy struct {
+	metric func(*exitNodeStats) int64
+}
+
+func (s leastStrategy) Pick(_ string, candidates []ExitNode, stats map[string]*exitNodeStats) ExitNode {
+	var best []ExitNode
+	lowest := int64(-1)
+	for _, v := range candidates {
+		value := int64(0)
+		if nodeStats, ok := stats[v.Key()]; ok {
+			value = s.metric(nodeStats)
+		}
+		if lowest == -1 || value < lowest {
+			lowest = value
+			best = best[:0]
+		}
+		if value == lowest {
+			best = append(best, v)
+		}
+	}
+	return best[rand.Intn(len(best))]
+}
+
+func (e ExitNode) weight() int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// caller must hold Mutex
+func (p *Proxy) pickExitNode(strategy string, pool string, nodes []ExitNode, excluded map[string]bool) (ExitNode, error) {
+	candidates := nodes
+	if len(excluded) > 0 {
+		candidates = make([]ExitNode, 0, len(nodes))
+		for _, v := range nodes {
+			if excluded[v.Key()] == false {
+				candidates = append(candidates, v)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return ExitNode{}, ErrNoExitNodes
+	}
+
+	if p.strategies == nil {
+		p.strategies = newStrategies()
+	}
+	if strategy == "" {
+		strategy = p.Strategy
+	}
+	selector, ok := p.strategies[strategy]
+	if !ok {
+		selector = p.strategies[StrategyRandom]
+	}
+	return selector.Pick(pool, candidates, p.stats), nil
+}
+
+func (p *Proxy) acquireExitNode(exitNode ExitNode) *exitNodeStats {
+	p.Mutex.Lock()
+	if p.stats == nil {
+		p.stats = map[string]*exitNodeStats{}
+	}
+	nodeStats, ok := p.stats[exitNode.Key()]
+	if !ok {
+		nodeStats = &exitNodeStats{}
+		p.stats[exitNode.Key()] = nodeStats
+	}
+	p.Mutex.Unlock()
+
+	atomic.AddInt64(&nodeStats.Active, 1)
+	return nodeStats
+}
+
+func (s *exitNodeStats) release() {
+	atomic.AddInt64(&s.Active, -1)
+}
+
+func (s *exitNodeStats) addBytes(bytes int64) {
+	atomic.AddInt64(&s.Bytes, bytes)
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"testing"
+)
+
+func testExitNodes(names ...string) []ExitNode {
+	var nodes []ExitNode
+	for _, v := range names {
+		nodes = append(nodes, ExitNode{InstanceID: "i1", Interface: v})
+	}
+	return nodes
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	strategy := newStrategies()[StrategyRoundRobin]
+	nodes := testExitNodes("a", "b", "c")
+	want := []string{"a", "b", "c", "a", "b"}
+	for i, w := range want {
+		if got := strategy.Pick("all", nodes, nil).Interface; got != w {
+			t.Errorf("pick %d = %s, want %s", i, got, w)
+		}
+	}
+	if got := strategy.Pick("us", nodes, nil).Interface; got != "a" {
+		t.Errorf("first pick of another pool = %s, want a", got)
+	}
+}
+
+func TestLeastStrategies(t *testing.T) {
+	nodes := testExitNodes("a", "b", "c")
+	stats := map[string]*exitNodeStats{
+		nodes[0].Key(): {Active: 3, Bytes: 10},
+		nodes[1].Key(): {Active: 1, Bytes: 500},
+		nodes[2].Key(): {Active: 2, Bytes: 20},
+	}
+	tests := []struct {
+		strategy string
+		stats    map[string]*exitNodeStats
+		want     []string
+	}{
+		{StrategyLeastConn, stats, []string{"b"}},
+		{StrategyLeastBytes, stats, []string{"a"}},
+		{StrategyLeastConn, map[string]*exitNodeStats{nodes[0].Key(): {Active: 1}}, []string{"b", "c"}},
+		{StrategyLeastConn, nil, []string{"a", "b", "c"}},
+	}
+	strategies := newStrategies()
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := strategies[tt.strategy].Pick("all", nodes, tt.stats).Interface
+			if contains(tt.want, got) == false {
+				t.Errorf("%s picked %s, want one of %v", tt.strategy, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	nodes := testExitNodes("heavy", "light", "zero")
+	nodes[0].Weight = 98
+	nodes[1].Weight = 1
+	strategy := newStrategies()[StrategyWeighted]
+	picks := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		picks[strategy.Pick("all", nodes, nil).Interface]++
+	}
+	if picks["heavy"] < 900 {
+		t.Errorf("heavy node picked %d of 1000 times, want about 980", picks["heavy"])
+	}
+	if picks["heavy"]+picks["light"]+picks["zero"] != 1000 {
+		t.Errorf("picks = %v", picks)
+	}
+}
+
+func TestPickExitNode(t *testing.T) {
+	nodes := testExitNodes("a", "b", "c")
+	tests := []struct {
+		name     string
+		strategy string
+		excluded map[string]bool
+		want     []string
+		wantErr  error
+	}{
+		{"random", StrategyRandom, nil, []string{"a", "b", "c"}, nil},
+		{"unknown strategy", "fastest", nil, []string{"a", "b", "c"}, nil},
+		{"excluded", StrategyRandom, map[string]bool{nodes[0].Key(): true, nodes[2].Key(): true}, []string{"b"}, nil},
+		{"all excluded", StrategyRandom,
+			map[string]bool{nodes[0].Key(): true, nodes[1].Key(): true, nodes[2].Key(): true}, nil, ErrNoExitNodes},
+	}
+	for _, tt := range tests {
+		var p Proxy
+		got, err := p.pickExitNode(tt.strategy, "all", nodes, tt.excluded)
+		if err != tt.wantErr {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && contains(tt.want, got.Interface) == false {
+			t.Errorf("%s: picked %s, want one of %v", tt.name, got.Interface, tt.want)
+		}
+	}
+	var p Proxy
+	if _, err := p.pickExitNode(StrategyRandom, "all", nil, nil); err != ErrNoExitNodes {
+		t.Errorf("empty pool error = %v, want %v", err, ErrNoExitNodes)
+	}
+}
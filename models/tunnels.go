@@ -0,0 +1,67 @@
+package models
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type Tunnel struct {
+	ID             uint64
+	Protocol       string
+	Host           string
+	RequestContext RequestContext
+	ExitNode       ExitNode
+	StartedAt      time.Time
+
+	source      net.Conn
+	destination net.Conn
+	nodeStats   *exitNodeStats
+}
+
+var tunnelIDs uint64
+
+func (p *Proxy) openTunnel(protocol string, host string, requestContext RequestContext, exitNode ExitNode, source net.Conn, destination net.Conn) *Tunnel {
+	tunnel := &Tunnel{
+		ID:             atomic.AddUint64(&tunnelIDs, 1),
+		Protocol:       protocol,
+		Host:           host,
+		RequestContext: requestContext,
+		ExitNode:       exitNode,
+		StartedAt:      time.Now(),
+		source:         source,
+		destination:    destination,
+		nodeStats:      p.acquireExitNode(exitNode),
+	}
+
+	// both copyIO directions count until they return, Shutdown waits on them
+	atomic.AddInt64(&p.activeCopies, 2)
+
+	p.tunnelMutex.Lock()
+	defer p.tunnelMutex.Unlock()
+	if p.tunnels == nil {
+		p.tunnels = map[uint64]*Tunnel{}
+	}
+	p.tunnels[tunnel.ID] = tunnel
+	return tunnel
+}
+
+// also gives back the user connection taken before dialing
+func (p *Proxy) closeTunnel(tunnel *Tunnel) {
+	tunnel.nodeStats.release()
+	p.releaseUserConnection(tunnel.RequestContext)
+
+	p.tunnelMutex.Lock()
+	defer p.tunnelMutex.Unlock()
+	delete(p.tunnels, tunnel.ID)
+}
+
+func (p *Proxy) Tunnels() []*Tunnel {
+	p.tunnelMutex.Lock()
+	defer p.tunnelMutex.Unlock()
+	tunnels := make([]*Tunnel, 0, len(p.tunnels))
+	for _, tunnel := range p.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const upstreamDialTimeout = 10 * time.Second
+
+func init() {
+	proxy.RegisterDialerType("socks4", newSocks4Dialer)
+	proxy.RegisterDialerType("socks4a", newSocks4Dialer)
+}
+
+// entries without a scheme are HTTP proxies
+func parseUpstream(upstream string) (*url.URL, error) {
+	if strings.Contains(upstream, "://") == false {
+		upstream = "http://" + upstream
+	}
+	return url.Parse(upstream)
+}
+
+func (p *Proxy) upstreamTimeout() time.Duration {
+	if p.Timeout > 0 {
+		return time.Duration(p.Timeout) * time.Second
+	}
+	return upstreamDialTimeout
+}
+
+func isSocksUpstream(upstreamURL *url.URL) bool {
+	switch upstreamURL.Scheme {
+	case "socks5", "socks5h", "socks4", "socks4a":
+		return true
+	}
+	return false
+}
+
+// with authupstream the client credentials replace the upstream ones
+func (p *Proxy) socksUpstreamDialer(upstreamURL *url.URL, requestContext RequestContext) (proxy.ContextDialer, error) {
+	if p.AuthUpstream == true && requestContext.RawCreds != "" {
+		if data, err := b64.StdEncoding.DecodeString(requestContext.RawCreds); err == nil {
+			if userParts := strings.SplitN(string(data), ":", 2); len(userParts) == 2 {
+				upstreamURL.User = url.UserPassword(userParts[0], userParts[1])
+			}
+		}
+	}
+
+	dialer, err := proxy.FromURL(upstreamURL, &net.Dialer{Timeout: upstreamDialTimeout})
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("upstream dialer for %s does not support contexts", upstreamURL.Scheme)
+	}
+	return contextDialer, nil
+}
+
+type socks4Dialer struct {
+	address string
+	userID  string
+	remote  bool
+	forward proxy.Dialer
+}
+
+func newSocks4Dialer(upstreamURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	dialer := &socks4Dialer{
+		address: upstreamURL.Host,
+		remote:  upstreamURL.Scheme == "socks4a",
+		forward: forward,
+	}
+	if upstreamURL.User != nil {
+		dialer.userID = upstreamURL.User.Username()
+	}
+	return dialer, nil
+}
+
+func (d *socks4Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *socks4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("socks4: unsupported network %s", network)
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+
+	// socks4a signals remote resolution with the 0.0.0.x address and appends the hostname
+	request := []byte{0x04, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(request[2:], uint16(port))
+	ip := net.ParseIP(host).To4()
+	if ip == nil && d.remote == false {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0].To4()
+	}
+	if ip != nil {
+		request = append(request, ip...)
+	} else {
+		request = append(request, 0, 0, 0, 1)
+	}
+	request = append(request, d.userID...)
+	request = append(request, 0)
+	if ip == nil {
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+
+	var conn net.Conn
+	if contextDialer, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = contextDialer.DialContext(ctx, "tcp", d.address)
+	} else {
+		conn, err = d.forward.Dial("tcp", d.address)
+	}
+	if err != nil {
+		return nil, exitNodeError{err: err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err = conn.Write(request); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	response := make([]byte, 8)
+	if _, err = io.ReadFull(conn, response); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if response[1] != 0x5a {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: socks4 code %d", ErrUpstreamRefused, response[1])
+	}
+	return conn, nil
+}
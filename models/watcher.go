@@ -0,0 +1,56 @@
+package models
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"path/filepath"
+	"time"
+)
+
+const watchDebounce = 500 * time.Millisecond
+
+// the parent directory is watched so editors replacing the file are still picked up
+func WatchFile(filename string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	absolutePath, err := filepath.Abs(filename)
+	if err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(absolutePath)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != absolutePath {
+					continue
+				}
+				if event.Has(fsnotify.Write) == false && event.Has(fsnotify.Create) == false && event.Has(fsnotify.Rename) == false {
+					continue
+				}
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(watchDebounce, onChange)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warn().Err(err).Str("filename", filename).Msg("WatchFile")
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+type accessList struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+type whitelistFile struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		prefix, err := parsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", v, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (p *Proxy) loadAccessList() error {
+	allow, err := parsePrefixes(strings.Split(p.Whitelist, ","))
+	if err != nil {
+		return err
+	}
+	deny, err := parsePrefixes(strings.Split(p.DenyList, ","))
+	if err != nil {
+		return err
+	}
+	if p.WhitelistFile != "" {
+		data, err := os.ReadFile(p.WhitelistFile)
+		if err != nil {
+			return err
+		}
+		file := whitelistFile{}
+		if err = yaml.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("can't parse whitelist file: %w", err)
+		}
+		fileAllow, err := parsePrefixes(file.Allow)
+		if err != nil {
+			return err
+		}
+		fileDeny, err := parsePrefixes(file.Deny)
+		if err != nil {
+			return err
+		}
+		allow = append(allow, fileAllow...)
+		deny = append(deny, fileDeny...)
+	}
+
+	p.accessMutex.Lock()
+	defer p.accessMutex.Unlock()
+	p.accessList = accessList{allow: allow, deny: deny}
+	return nil
+}
+
+func (p *Proxy) ReloadAccessList() {
+	if err := p.loadAccessList(); err != nil {
+		log.Error().Err(err).Str("method", "ReloadAccessList").Str("filename", p.WhitelistFile).Msg("keeping previous whitelist")
+		return
+	}
+	p.accessMutex.RLock()
+	defer p.accessMutex.RUnlock()
+	log.Info().Int("allow", len(p.accessList.allow)).Int("deny", len(p.accessList.deny)).Msg("whitelist reloaded")
+}
+
+// the deny list wins
+func (p *Proxy) clientRejection(remoteAddress string) string {
+	p.accessMutex.RLock()
+	list := p.accessList
+	p.accessMutex.RUnlock()
+	if len(list.allow) == 0 && len(list.deny) == 0 {
+		return ""
+	}
+
+	cause, reason := "", ""
+	addr, ok := parseRemoteAddr(remoteAddress)
+	if ok == false || (len(list.allow) > 0 && containsAddr(list.allow, addr) == false) {
+		cause, reason = causeNotWhitelisted, "not_whitelisted"
+	}
+	if ok == true && containsAddr(list.deny, addr) {
+		cause, reason = causeClientDenied, "denied"
+	}
+	if cause != "" {
+		log.Debug().Str("address", remoteAddress).Str("cause", cause).Msg("client rejected")
+		p.LogRejection(RequestContext{}, reason)
+	}
+	return cause
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}